@@ -0,0 +1,102 @@
+package firmware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dividat/driver/src/dividat-driver/senso/protocol"
+)
+
+// How long to browse for Sensos when updating all of them
+const batchDiscoveryDuration = 10 * time.Second
+
+// Result of updating a single Senso in a batch
+type Result struct {
+	Serial string
+	// Final stage of the update
+	Stage   string
+	Message string
+	Err     error
+}
+
+// DiscoverSerials returns the serials of all Sensos discovered within the batch discovery duration
+func DiscoverSerials(parentCtx context.Context, report func(string)) ([]string, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, batchDiscoveryDuration)
+	defer cancel()
+
+	devices, err := discoverDevices(ctx, "_sensoControl._tcp", report)
+	if err != nil {
+		return nil, err
+	}
+
+	var serials []string
+	for serial, addrs := range devices {
+		if strings.HasPrefix(serial, "UNKNOWN-") {
+			report(fmt.Sprintf("Skipping Senso without serial at %v.", addrs))
+		} else {
+			serials = append(serials, serial)
+		}
+	}
+	sort.Strings(serials)
+	return serials, nil
+}
+
+// UpdateAll updates the Sensos with the given serials, running at most concurrency updates at once.
+//
+// A failing update does not affect the others. Results are returned in the order of serials.
+func UpdateAll(ctx context.Context, image []byte, serials []string, concurrency int, expectedVersion *protocol.Version, onProgress func(string, Progress)) []Result {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([]Result, len(serials))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for ix, serial := range serials {
+		wg.Add(1)
+		go func(ix int, serial string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			var final Progress
+			address := ""
+			err := Update(ctx, image, &serial, &address, expectedVersion, func(progress Progress) {
+				final = progress
+				onProgress(serial, progress)
+			})
+			results[ix] = Result{Serial: serial, Stage: final.Stage, Message: final.Message, Err: err}
+		}(ix, serial)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// BatchExitCode returns the highest exit code of all results
+func BatchExitCode(results []Result) int {
+	code := ExitSuccess
+	for _, result := range results {
+		if resultCode := ExitCode(result.Err); resultCode > code {
+			code = resultCode
+		}
+	}
+	return code
+}
+
+// PrintSummary writes a table with the outcome of every update
+func PrintSummary(w io.Writer, results []Result) {
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "SERIAL\tOUTCOME\tMESSAGE")
+	for _, result := range results {
+		fmt.Fprintf(table, "%s\t%s\t%s\n", result.Serial, result.Stage, result.Message)
+	}
+	table.Flush()
+}
@@ -0,0 +1,167 @@
+package firmware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/dividat/driver/src/dividat-driver/senso/protocol"
+)
+
+// How long to wait for Senso to return after the image has been transmitted
+const deviceReturnTimeout = 3 * time.Minute
+
+// How long to wait between attempts to reach Senso after the update
+const returnRetryInterval = 5 * time.Second
+
+// Timeout for querying device information
+const devInfoTimeout = 5 * time.Second
+
+// Exit codes of the command-line interface
+const (
+	ExitSuccess           = 0
+	ExitFailed            = 1
+	ExitWrongVersion      = 3
+	ExitDeviceNotReturned = 4
+	ExitVersionUnchanged  = 5
+)
+
+// WrongVersionError is returned if Senso reports another software version than expected after the update
+type WrongVersionError struct {
+	Expected protocol.Version
+	Reported protocol.Version
+}
+
+func (err *WrongVersionError) Error() string {
+	return fmt.Sprintf("Senso reports firmware %s after the update, expected %s.", err.Reported, err.Expected)
+}
+
+// UnchangedVersionError is returned if no version is expected and Senso reports the same version as before the update
+type UnchangedVersionError struct {
+	Version protocol.Version
+}
+
+func (err *UnchangedVersionError) Error() string {
+	return fmt.Sprintf("Senso still reports firmware %s after the update, give the expected version to confirm an update to the same version.", err.Version)
+}
+
+// DeviceNotReturnedError is returned if Senso could not be reached after the update
+type DeviceNotReturnedError struct {
+	Cause error
+}
+
+func (err *DeviceNotReturnedError) Error() string {
+	return fmt.Sprintf("Senso did not return after the update: %v", err.Cause)
+}
+
+// ExitCode returns the exit code for the outcome of an update
+func ExitCode(err error) int {
+	switch err.(type) {
+	case nil:
+		return ExitSuccess
+	case *WrongVersionError:
+		return ExitWrongVersion
+	case *DeviceNotReturnedError:
+		return ExitDeviceNotReturned
+	case *UnchangedVersionError:
+		return ExitVersionUnchanged
+	default:
+		return ExitFailed
+	}
+}
+
+// outcomeStage returns the final progress stage for the outcome of an update
+func outcomeStage(err error) string {
+	switch err.(type) {
+	case nil:
+		return StageDone
+	case *WrongVersionError:
+		return StageWrongVersion
+	case *DeviceNotReturnedError:
+		return StageDeviceNotReturned
+	case *UnchangedVersionError:
+		return StageVersionUnchanged
+	default:
+		return StageFailed
+	}
+}
+
+// waitForDevice waits for Senso to reappear on the network and answer a DEV_INFO request.
+//
+// Without a serial, the first Senso discovered is taken to be the updated one.
+func waitForDevice(parentCtx context.Context, deviceSerial *string, configuredAddr string, report func(string)) (*protocol.DevInfo, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, deviceReturnTimeout)
+	defer cancel()
+
+	// Only report the outcome of attempts, not every rediscovery
+	quiet := func(string) {}
+
+	for {
+		host := configuredAddr
+		var err error
+		if host == "" {
+			discoveryCtx, cancelDiscovery := context.WithTimeout(ctx, returnRetryInterval)
+			_, host, err = discoverFirst("_sensoControl._tcp", deviceSerial, discoveryCtx, quiet)
+			cancelDiscovery()
+		}
+
+		if err == nil {
+			var devInfo *protocol.DevInfo
+			devInfo, err = queryDevInfo(ctx, host)
+			if err == nil {
+				report(fmt.Sprintf("Senso %s at %s reports firmware %s.", devInfo.Controller.SerialNumber, host, devInfo.Controller.SoftwareVersion))
+				return devInfo, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if parentCtx.Err() != nil {
+				return nil, parentCtx.Err()
+			}
+			return nil, &DeviceNotReturnedError{Cause: err}
+		case <-time.After(returnRetryInterval):
+		}
+	}
+}
+
+// queryDevInfo requests device information on the control channel of Senso
+func queryDevInfo(ctx context.Context, host string) (*protocol.DevInfo, error) {
+	dialer := net.Dialer{Timeout: devInfoTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, controllerPort))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(devInfoTimeout))
+
+	_, err = conn.Write(protocol.NewRequest(protocol.BlockTypeDevInfo, nil).Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := protocol.NewDecoder()
+	buffer := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("no device information received: %v", err)
+		}
+		decoder.Write(buffer[:n])
+
+		for {
+			packet, err := decoder.Next()
+			if err != nil {
+				continue
+			} else if packet == nil {
+				break
+			}
+			for _, block := range packet.Blocks {
+				if block.Type == protocol.BlockTypeDevInfo|protocol.ResponseFlag {
+					return protocol.DecodeDevInfo(block.Data)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package firmware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// browse calls onEntry for every entry discovered until ctx is done or onEntry returns false
+func browse(ctx context.Context, service string, onEntry func(*zeroconf.ServiceEntry) bool) error {
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		return fmt.Errorf("Initializing discovery failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	entries := make(chan *zeroconf.ServiceEntry)
+	err = resolver.Browse(ctx, service, "local.", entries)
+	if err != nil {
+		return fmt.Errorf("Browsing failed: %v", err)
+	}
+	// Keep reading after returning, until browsing has stopped
+	defer func() {
+		go func() {
+			for range entries {
+			}
+		}()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case entry, more := <-entries:
+			if !more || !onEntry(entry) {
+				return nil
+			}
+		}
+	}
+}
+
+// discoverDevices browses a service until ctx is done, returning the addresses of every device by serial
+func discoverDevices(ctx context.Context, service string, report func(string)) (map[string][]string, error) {
+	report(fmt.Sprintf("Starting discovery: %s", service))
+
+	devices := make(map[string][]string)
+	entriesWithoutSerial := 0
+	err := browse(ctx, service, func(entry *zeroconf.ServiceEntry) bool {
+		serial, ok := entrySerial(entry)
+		if !ok {
+			entriesWithoutSerial++
+			serial = fmt.Sprintf("UNKNOWN-%d", entriesWithoutSerial)
+		}
+		for _, addrCandidate := range entry.AddrIPv4 {
+			if addrCandidate.IsUnspecified() {
+				report(fmt.Sprintf("Skipping discovered address 0.0.0.0 for %s.", serial))
+			} else if !containsString(devices[serial], addrCandidate.String()) {
+				devices[serial] = append(devices[serial], addrCandidate.String())
+			}
+		}
+		return true
+	})
+	return devices, err
+}
+
+// discover the address of a device, which must be the only one discovered unless a serial is given.
+//
+// With a serial, discovery ends as soon as the device has been found. Otherwise
+// the service is browsed until ctx is done, to make sure there is only one device.
+func discover(service string, deviceSerial *string, ctx context.Context, report func(string)) (serial string, addr string, err error) {
+	if deviceSerial != nil {
+		return discoverFirst(service, deviceSerial, ctx, report)
+	}
+
+	devices, err := discoverDevices(ctx, service, report)
+	if err != nil {
+		return
+	}
+
+	if len(devices) == 0 {
+		err = errors.New("No Sensos discovered.")
+	} else if len(devices) == 1 {
+		for discoveredSerial, addrs := range devices {
+			serial = discoveredSerial
+			addr = addrs[0]
+			report(fmt.Sprintf("Discovered %s at %v, using %s.", serial, addrs, addr))
+		}
+	} else {
+		err = fmt.Errorf("Discovered multiple Sensos: %v. Please specify a serial or IP.", devices)
+	}
+	return
+}
+
+// discoverFirst finds the address of the device with the given serial, or of any device if no serial is given.
+//
+// Discovery ends as soon as a device has been found. Without a serial, this is
+// only sound if a single device is expected, for instance because discover made
+// sure there is only one.
+func discoverFirst(service string, deviceSerial *string, ctx context.Context, report func(string)) (serial string, addr string, err error) {
+	report(fmt.Sprintf("Starting discovery: %s", service))
+
+	var addrs []string
+	err = browse(ctx, service, func(entry *zeroconf.ServiceEntry) bool {
+		entrySerial, _ := entrySerial(entry)
+		if deviceSerial != nil && entrySerial != *deviceSerial {
+			return true
+		}
+		for _, addrCandidate := range entry.AddrIPv4 {
+			if !addrCandidate.IsUnspecified() {
+				addrs = append(addrs, addrCandidate.String())
+			}
+		}
+		serial = entrySerial
+		return len(addrs) == 0
+	})
+	if err != nil {
+		return
+	}
+
+	if len(addrs) == 0 && deviceSerial == nil {
+		err = errors.New("No Sensos discovered.")
+	} else if len(addrs) == 0 {
+		err = fmt.Errorf("Could not find Senso %s.", *deviceSerial)
+	} else {
+		addr = addrs[0]
+		report(fmt.Sprintf("Discovered %s at %v, using %s.", serial, addrs, addr))
+	}
+	return
+}
+
+// entrySerial returns the cleaned serial from the TXT records of an entry
+func entrySerial(entry *zeroconf.ServiceEntry) (string, bool) {
+	for _, txt := range entry.Text {
+		if strings.HasPrefix(txt, "ser_no=") {
+			return cleanSerial(strings.TrimPrefix(txt, "ser_no=")), true
+		}
+	}
+	return "", false
+}
+
+func cleanSerial(serialStr string) string {
+	// Senso firmware up to 3.8.0 adds garbage at end of serial in mDNS
+	// entries due to improper string sizing.  Because bootloader firmware
+	// will not be updated via Ethernet, the problem will stay around for a
+	// while and we clean up the serial here to produce readable output for
+	// older devices.
+	return strings.Split(serialStr, "\\000")[0]
+}
+
+func containsString(slice []string, candidate string) bool {
+	for _, member := range slice {
+		if member == candidate {
+			return true
+		}
+	}
+	return false
+}
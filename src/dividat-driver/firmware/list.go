@@ -0,0 +1,178 @@
+package firmware
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// Services advertised by Senso, depending on whether it runs the application or the bootloader
+var modeByService = map[string]string{
+	"_sensoControl._tcp": ModeApplication,
+	"_sensoUpdate._udp":  ModeBootloader,
+}
+
+// Modes of a listed Senso
+const (
+	ModeApplication = "application"
+	ModeBootloader  = "bootloader"
+)
+
+// Listing of a Senso discovered via mDNS
+type Listing struct {
+	Serial   string   `json:"serial"`
+	Mode     string   `json:"mode"`
+	Service  string   `json:"service"`
+	Instance string   `json:"instance"`
+	HostName string   `json:"hostName"`
+	IPv4     []string `json:"ipv4"`
+	IPv6     []string `json:"ipv6"`
+	Port     int      `json:"port"`
+	Text     []string `json:"txt"`
+}
+
+// ListCommand is the command-line interface to ListSensos
+func ListCommand(flags []string) {
+	listFlags := flag.NewFlagSet("list-sensos", flag.ExitOnError)
+	duration := listFlags.Duration("duration", 5*time.Second, "How long to browse for Sensos")
+	format := listFlags.String("format", "table", "Output format (table or json)")
+	listFlags.Parse(flags)
+
+	if *format != "table" && *format != "json" {
+		fmt.Printf("Unknown format %q, expected table or json.\n", *format)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	listings, err := ListSensos(ctx)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(listings)
+	} else {
+		printListings(os.Stdout, listings)
+	}
+}
+
+// ListSensos browses for Sensos in application and bootloader mode until ctx is done
+func ListSensos(ctx context.Context) ([]Listing, error) {
+	var mutex sync.Mutex
+	listings := make(map[string]*Listing)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(modeByService))
+	for service, mode := range modeByService {
+		wg.Add(1)
+		go func(service string, mode string) {
+			defer wg.Done()
+			err := browse(ctx, service, func(entry *zeroconf.ServiceEntry) bool {
+				mutex.Lock()
+				defer mutex.Unlock()
+				addListing(listings, service, mode, entry)
+				return true
+			})
+			if err != nil {
+				errs <- err
+			}
+		}(service, mode)
+	}
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+
+	sorted := make([]Listing, 0, len(listings))
+	for _, listing := range listings {
+		sorted = append(sorted, *listing)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Serial != sorted[j].Serial {
+			return sorted[i].Serial < sorted[j].Serial
+		}
+		return sorted[i].Mode < sorted[j].Mode
+	})
+	return sorted, nil
+}
+
+// addListing adds an entry to the listings, merging addresses if the service instance is already listed
+func addListing(listings map[string]*Listing, service string, mode string, entry *zeroconf.ServiceEntry) {
+	key := service + "/" + entry.Instance
+	listing, ok := listings[key]
+	if !ok {
+		serial, _ := entrySerial(entry)
+		listing = &Listing{
+			Serial:   serial,
+			Mode:     mode,
+			Service:  service,
+			Instance: unescapeInstance(entry.Instance),
+			HostName: entry.HostName,
+			IPv4:     []string{},
+			IPv6:     []string{},
+			Port:     entry.Port,
+			Text:     entry.Text,
+		}
+		listings[key] = listing
+	}
+	for _, ip := range entry.AddrIPv4 {
+		if !containsString(listing.IPv4, ip.String()) {
+			listing.IPv4 = append(listing.IPv4, ip.String())
+		}
+	}
+	for _, ip := range entry.AddrIPv6 {
+		if !containsString(listing.IPv6, ip.String()) {
+			listing.IPv6 = append(listing.IPv6, ip.String())
+		}
+	}
+}
+
+// unescapeInstance removes the escaping of special characters in DNS labels, e.g. `Senso\ 1` becomes `Senso 1`
+func unescapeInstance(instance string) string {
+	var unescaped strings.Builder
+	escaped := false
+	for _, r := range instance {
+		if r == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		unescaped.WriteRune(r)
+	}
+	return unescaped.String()
+}
+
+func printListings(w io.Writer, listings []Listing) {
+	if len(listings) == 0 {
+		fmt.Fprintln(w, "No Sensos discovered.")
+		return
+	}
+
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "SERIAL\tMODE\tADDRESSES\tPORT\tTXT")
+	for _, listing := range listings {
+		serial := listing.Serial
+		if serial == "" {
+			serial = "unknown"
+		}
+		addresses := append(append([]string{}, listing.IPv4...), listing.IPv6...)
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%s\n", serial, listing.Mode, strings.Join(addresses, ", "), listing.Port, strings.Join(listing.Text, " "))
+	}
+	table.Flush()
+}
@@ -4,17 +4,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
-	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/grandcat/zeroconf"
 	"github.com/pin/tftp"
+
+	"github.com/dividat/driver/src/dividat-driver/senso/protocol"
 )
 
 const tftpPort = "69"
@@ -25,38 +27,189 @@ func Command(flags []string) {
 	updateFlags := flag.NewFlagSet("update", flag.ExitOnError)
 	imagePath := updateFlags.String("i", "", "Firmware image path")
 	configuredAddr := updateFlags.String("a", "", "Senso address (optional)")
-	sensoSerial := updateFlags.String("s", "", "Senso serial (optional)")
+	sensoSerial := updateFlags.String("s", "", "Senso serial, or comma separated serials to update several Sensos (optional)")
+	all := updateFlags.Bool("all", false, "Update all discovered Sensos")
+	concurrency := updateFlags.Int("concurrency", 1, "Number of Sensos to update at once when updating several Sensos")
+	signaturePath := updateFlags.String("sig", "", "Detached image signature path (default: image path with .sig appended)")
+	manifestPath := updateFlags.String("manifest", "", "Signed manifest path, the signature is expected at the manifest path with .sig appended (optional)")
+	keyPath := updateFlags.String("key", "", "PEM encoded public key to verify signatures with (default: embedded Dividat key)")
+	force := updateFlags.Bool("force", false, "Flash the image even if it can not be verified")
+	expectVersion := updateFlags.String("expect-version", "", "Firmware version expected after the update (default: version from manifest)")
 	updateFlags.Parse(flags)
 
 	var deviceSerial *string = nil
+	var serials []string
 	if *sensoSerial != "" {
 		deviceSerial = sensoSerial
+		serials = strings.Split(*sensoSerial, ",")
+	}
+	batch := *all || len(serials) > 1
+	if batch && *configuredAddr != "" {
+		fmt.Println("Can not update several Sensos at a single address.")
+		os.Exit(ExitFailed)
 	}
 
 	if *imagePath == "" {
 		flag.PrintDefaults()
 		return
 	}
-	file, err := os.Open(*imagePath)
+	image, err := ioutil.ReadFile(*imagePath)
 	if err != nil {
 		fmt.Printf("Could not open image file: %v\n", err)
 		os.Exit(1)
 	}
 
-	err = Update(context.Background(), file, deviceSerial, configuredAddr)
+	verification, err := readVerification(*imagePath, *signaturePath, *manifestPath, *keyPath)
 	if err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
 	}
+	manifest, err := Verify(image, verification)
+	if err != nil && *force {
+		fmt.Printf("Flashing unverified image: %v\n", err)
+	} else if err != nil {
+		fmt.Printf("%v\nRefusing to flash, use -force to flash anyway.\n", err)
+		os.Exit(ExitFailed)
+	} else {
+		fmt.Println("✓ Image verified.")
+	}
+
+	expectedVersion, err := ExpectedVersion(*expectVersion, manifest)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(ExitFailed)
+	}
+
+	if batch {
+		os.Exit(updateBatch(image, serials, *all, *concurrency, expectedVersion))
+	}
+
+	err = Update(context.Background(), image, deviceSerial, configuredAddr, expectedVersion, printProgress)
+	os.Exit(ExitCode(err))
+}
+
+// updateBatch updates several Sensos, printing a summary at the end, and returns the exit code
+func updateBatch(image []byte, serials []string, all bool, concurrency int, expectedVersion *protocol.Version) int {
+	ctx := context.Background()
+
+	if all {
+		discovered, err := DiscoverSerials(ctx, func(message string) { fmt.Println(message) })
+		if err != nil {
+			fmt.Println(err.Error())
+			return ExitFailed
+		} else if len(discovered) == 0 {
+			fmt.Println("No Sensos discovered.")
+			return ExitFailed
+		}
+		serials = discovered
+	}
+	fmt.Printf("Updating %d Sensos: %s\n", len(serials), strings.Join(serials, ", "))
+
+	var printMutex sync.Mutex
+	results := UpdateAll(ctx, image, serials, concurrency, expectedVersion, func(serial string, progress Progress) {
+		if progress.Stage == StageTransferring && progress.BytesTransferred < progress.BytesTotal {
+			return
+		}
+		printMutex.Lock()
+		fmt.Printf("[%s] %s\n", serial, progress.Message)
+		printMutex.Unlock()
+	})
+
+	fmt.Println()
+	PrintSummary(os.Stdout, results)
+	return BatchExitCode(results)
+}
+
+// ExpectedVersion returns the version given explicitly or stated in the manifest, nil if neither is known
+func ExpectedVersion(version string, manifest *Manifest) (*protocol.Version, error) {
+	if version == "" && manifest != nil {
+		version = manifest.Version
+	}
+	if version == "" {
+		return nil, nil
+	}
+	expected, err := protocol.ParseVersion(version)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid expected version: %v", err)
+	}
+	return &expected, nil
+}
+
+// readVerification reads the signature or manifest files for verifying the image
+func readVerification(imagePath string, signaturePath string, manifestPath string, keyPath string) (verification Verification, err error) {
+	if manifestPath != "" {
+		verification.Manifest, err = ioutil.ReadFile(manifestPath)
+		if err != nil {
+			err = fmt.Errorf("Could not read manifest: %v", err)
+			return
+		}
+		verification.ManifestSignature, err = ioutil.ReadFile(manifestPath + ".sig")
+		if err != nil {
+			err = fmt.Errorf("Could not read manifest signature: %v", err)
+			return
+		}
+	} else if signaturePath != "" {
+		verification.Signature, err = ioutil.ReadFile(signaturePath)
+		if err != nil {
+			err = fmt.Errorf("Could not read signature: %v", err)
+			return
+		}
+	} else if signature, readErr := ioutil.ReadFile(imagePath + ".sig"); readErr == nil {
+		verification.Signature = signature
+	}
+
+	if keyPath != "" {
+		var pemData []byte
+		pemData, err = ioutil.ReadFile(keyPath)
+		if err != nil {
+			err = fmt.Errorf("Could not read public key: %v", err)
+			return
+		}
+		verification.PublicKey, err = ParsePublicKey(pemData)
+		if err != nil {
+			err = fmt.Errorf("Invalid public key: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
+// printProgress prints progress messages, omitting intermediate transfer progress
+func printProgress(progress Progress) {
+	if progress.Stage == StageTransferring && progress.BytesTransferred < progress.BytesTotal {
+		return
+	}
+	fmt.Println(progress.Message)
 }
 
-// Firmware update workhorse
-func Update(parentCtx context.Context, image io.Reader, deviceSerial *string, configuredAddr *string) (fail error) {
+// Firmware update workhorse, reporting progress to onProgress until a final stage is reached.
+//
+// After transmitting the image, Update waits for Senso to return and compares
+// the firmware version it reports with expectedVersion, if given. Otherwise the
+// version must differ from the version reported before the update. If that
+// version can not be queried either, Senso returning is the only confirmation.
+func Update(parentCtx context.Context, image []byte, deviceSerial *string, configuredAddr *string, expectedVersion *protocol.Version, onProgress func(Progress)) (fail error) {
+	report := func(stage string) func(string) {
+		return func(message string) {
+			onProgress(Progress{Stage: stage, Message: message})
+		}
+	}
+
+	var devInfo *protocol.DevInfo
+	defer func() {
+		if fail != nil {
+			report(outcomeStage(fail))(fail.Error())
+		} else {
+			report(StageDone)(fmt.Sprintf("✓ Senso is running firmware %s.", devInfo.Controller.SoftwareVersion))
+		}
+	}()
+
 	// Discover Senso IP
 	var controllerHost string
 	if *configuredAddr == "" {
 		ctx, cancel := context.WithTimeout(parentCtx, 5*time.Second)
-		discoveredAddr, err := discover("_sensoControl._tcp", deviceSerial, ctx)
+		discoveredSerial, discoveredAddr, err := discover("_sensoControl._tcp", deviceSerial, ctx, report(StageDiscovering))
 		cancel()
 		if err != nil {
 			fail = err
@@ -64,30 +217,49 @@ func Update(parentCtx context.Context, image io.Reader, deviceSerial *string, co
 		}
 
 		controllerHost = discoveredAddr
+		// Look for the same device after rebooting
+		if deviceSerial == nil && !strings.HasPrefix(discoveredSerial, "UNKNOWN-") {
+			deviceSerial = &discoveredSerial
+		}
 	} else {
 		controllerHost = *configuredAddr
 	}
 
+	// Without an expected version, the update is confirmed by a change of version
+	var previousVersion *protocol.Version
+	if expectedVersion == nil {
+		previous, err := queryDevInfo(parentCtx, controllerHost)
+		if err != nil {
+			report(StageDiscovering)(fmt.Sprintf("Could not query firmware version before the update, only confirming that Senso returns: %v", err))
+		} else {
+			previousVersion = &previous.Controller.SoftwareVersion
+			report(StageDiscovering)(fmt.Sprintf("Senso is running firmware %s before the update.", *previousVersion))
+		}
+	}
+
 	// Request reboot into boot controller
 	err := sendDfuCommand(controllerHost, controllerPort)
 	if err != nil {
 		fail = err
 		return
 	}
+	report(StageDfuSent)(fmt.Sprintf("Sent DFU command to %s.", net.JoinHostPort(controllerHost, controllerPort)))
 
-	// Re-discover Senso IP in case it changes on reboot
+	// Re-discover Senso IP in case it changes on reboot. Without a serial, the
+	// only Senso discovered before is expected, so the first one found is used.
+	waiting := report(StageWaitingForBootloader)
 	var dfuHost string
 	if *configuredAddr == "" {
 		ctx, cancel := context.WithTimeout(parentCtx, 60*time.Second)
-		discoveredAddr, err := discover("_sensoUpdate._udp", deviceSerial, ctx)
+		_, discoveredAddr, err := discoverFirst("_sensoUpdate._udp", deviceSerial, ctx, waiting)
 		cancel()
 		if err != nil {
 			// Try to discover boot controller via legacy identifier
 			ctx, cancel := context.WithTimeout(parentCtx, 60*time.Second)
-			legacyDiscoveredAddr, err := discover("_sensoControl._tcp", deviceSerial, ctx)
+			_, legacyDiscoveredAddr, err := discoverFirst("_sensoControl._tcp", deviceSerial, ctx, waiting)
 			cancel()
 			if err != nil {
-				fmt.Printf("Could not discover update service, trying to fall back to previous discovery %s.\n", controllerHost)
+				waiting(fmt.Sprintf("Could not discover update service, trying to fall back to previous discovery %s.", controllerHost))
 				dfuHost = controllerHost
 			} else {
 				dfuHost = legacyDiscoveredAddr
@@ -100,15 +272,43 @@ func Update(parentCtx context.Context, image io.Reader, deviceSerial *string, co
 	}
 
 	// Wait briefly after discovery to ensure proper TFTP startup
-	time.Sleep(5 * time.Second)
+	waiting("Waiting for TFTP server to start.")
+	select {
+	case <-parentCtx.Done():
+		fail = parentCtx.Err()
+		return
+	case <-time.After(5 * time.Second):
+	}
 
 	// Transmit firmware via TFTP
-	err = putTFTP(dfuHost, tftpPort, image)
+	err = putTFTP(dfuHost, tftpPort, image, func(transferred int64, total int64) {
+		onProgress(Progress{
+			Stage:            StageTransferring,
+			Message:          fmt.Sprintf("%d of %d bytes sent", transferred, total),
+			BytesTransferred: transferred,
+			BytesTotal:       total,
+		})
+	})
+	if err != nil {
+		fail = err
+		return
+	}
+
+	// Confirm that Senso returns with the new firmware
+	report(StageWaitingForDevice)("✓ Firmware transmitted to Senso, waiting for Senso to return.")
+	devInfo, err = waitForDevice(parentCtx, deviceSerial, *configuredAddr, report(StageWaitingForDevice))
 	if err != nil {
 		fail = err
 		return
 	}
-	fmt.Println("✓ Firmware transmitted to Senso.")
+	reported := devInfo.Controller.SoftwareVersion
+	if expectedVersion != nil && reported != *expectedVersion {
+		fail = &WrongVersionError{Expected: *expectedVersion, Reported: reported}
+		return
+	} else if previousVersion != nil && reported == *previousVersion {
+		fail = &UnchangedVersionError{Version: reported}
+		return
+	}
 	return
 }
 
@@ -130,9 +330,10 @@ func sendDfuCommand(host string, port string) error {
 
 	command := append(header, body...)
 
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%s", host, port))
+	address := net.JoinHostPort(host, port)
+	conn, err := net.Dial("tcp", address)
 	if err != nil {
-		return fmt.Errorf("Could not dial connection to Senso controller at %s:%s: %v", host, port, err)
+		return fmt.Errorf("Could not dial connection to Senso controller at %s: %v", address, err)
 	}
 	defer conn.Close()
 	time.Sleep(1 * time.Second)
@@ -142,13 +343,11 @@ func sendDfuCommand(host string, port string) error {
 		return fmt.Errorf("Could not send DFU command: %v", err)
 	}
 
-	fmt.Printf("Sent DFU command to %s:%s.\n", host, port)
-
 	return nil
 }
 
-func putTFTP(host string, port string, image io.Reader) error {
-	client, err := tftp.NewClient(fmt.Sprintf("%s:%s", host, port))
+func putTFTP(host string, port string, image []byte, onProgress func(transferred int64, total int64)) error {
+	client, err := tftp.NewClient(net.JoinHostPort(host, port))
 	if err != nil {
 		return fmt.Errorf("Could not create tftp client: %v", err)
 	}
@@ -156,83 +355,30 @@ func putTFTP(host string, port string, image io.Reader) error {
 	if err != nil {
 		return fmt.Errorf("Could not create send connection: %v", err)
 	}
-	n, err := rf.ReadFrom(image)
+	total := int64(len(image))
+	onProgress(0, total)
+	_, err = rf.ReadFrom(&progressReader{reader: bytes.NewReader(image), total: total, onProgress: onProgress})
 	if err != nil {
 		return fmt.Errorf("Could not read from file: %v", err)
 	}
-	fmt.Printf("%d bytes sent\n", n)
 	return nil
 }
 
-func discover(service string, deviceSerial *string, ctx context.Context) (addr string, err error) {
-	resolver, err := zeroconf.NewResolver(nil)
-	if err != nil {
-		err = fmt.Errorf("Initializing discovery failed: %v", err)
-		return
-	}
-
-	fmt.Printf("Starting discovery: %s\n", service)
-
-	entries := make(chan *zeroconf.ServiceEntry)
-
-	err = resolver.Browse(ctx, service, "local.", entries)
-	if err != nil {
-		err = fmt.Errorf("Browsing failed: %v", err)
-		return
-	}
-
-	devices := make(map[string][]string)
-	entriesWithoutSerial := 0
-	select {
-	case entry := <-entries:
-		if entry == nil {
-			break
-		}
-
-		var serial string
-		for ix, txt := range entry.Text {
-			if strings.HasPrefix(txt, "ser_no=") {
-				serial = cleanSerial(strings.TrimPrefix(txt, "ser_no="))
-				break
-			} else if ix == len(entry.Text)-1 {
-				entriesWithoutSerial++
-				serial = fmt.Sprintf("UNKNOWN-%d", entriesWithoutSerial)
-			}
-		}
-		if deviceSerial != nil && serial != *deviceSerial {
-			break
-		}
-		for _, addrCandidate := range entry.AddrIPv4 {
-			if addrCandidate.String() == "0.0.0.0" {
-				fmt.Printf("Skipping discovered address 0.0.0.0 for %s.\n", serial)
-			} else {
-				devices[serial] = append(devices[serial], addrCandidate.String())
-			}
-		}
-	}
-
-	if len(devices) == 0 && deviceSerial == nil {
-		err = errors.New("No Sensos discovered.")
-	} else if len(devices) == 0 && deviceSerial != nil {
-		err = fmt.Errorf("Could not find Senso %s.", *deviceSerial)
-	} else if len(devices) == 1 {
-		for serial, addrs := range devices {
-			addr = addrs[0]
-			fmt.Printf("Discovered %s at %v, using %s.\n", serial, addrs, addr)
-			return
-		}
-	} else {
-		err = fmt.Errorf("Discovered multiple Sensos: %v. Please specify a serial or IP.", devices)
-		return
-	}
-	return
+// progressReader reports every percent of the total that has been read
+type progressReader struct {
+	reader      io.Reader
+	transferred int64
+	total       int64
+	reported    int64
+	onProgress  func(transferred int64, total int64)
 }
 
-func cleanSerial(serialStr string) string {
-	// Senso firmware up to 3.8.0 adds garbage at end of serial in mDNS
-	// entries due to improper string sizing.  Because bootloader firmware
-	// will not be updated via Ethernet, the problem will stay around for a
-	// while and we clean up the serial here to produce readable output for
-	// older devices.
-	return strings.Split(serialStr, "\\000")[0]
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.transferred += int64(n)
+	if n > 0 && (r.transferred == r.total || (r.transferred-r.reported)*100 >= r.total) {
+		r.reported = r.transferred
+		r.onProgress(r.transferred, r.total)
+	}
+	return n, err
 }
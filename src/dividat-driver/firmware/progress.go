@@ -0,0 +1,39 @@
+package firmware
+
+// Stages of a firmware update
+const (
+	StageDiscovering          = "Discovering"
+	StageDfuSent              = "DfuSent"
+	StageWaitingForBootloader = "WaitingForBootloader"
+	StageTransferring         = "Transferring"
+	StageWaitingForDevice     = "WaitingForDevice"
+
+	// Final stages
+	StageDone              = "Done"
+	StageFailed            = "Failed"
+	StageWrongVersion      = "WrongVersion"
+	StageDeviceNotReturned = "DeviceNotReturned"
+	StageVersionUnchanged  = "VersionUnchanged"
+)
+
+// Progress of a firmware update
+type Progress struct {
+	Stage string `json:"stage"`
+
+	// Human readable description of the progress, the error if the update failed
+	Message string `json:"message"`
+
+	// Zero unless transferring
+	BytesTransferred int64 `json:"bytesTransferred"`
+	BytesTotal       int64 `json:"bytesTotal"`
+}
+
+// IsFinal returns true if the update has ended
+func (progress *Progress) IsFinal() bool {
+	switch progress.Stage {
+	case StageDone, StageFailed, StageWrongVersion, StageDeviceNotReturned, StageVersionUnchanged:
+		return true
+	default:
+		return false
+	}
+}
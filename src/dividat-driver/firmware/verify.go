@@ -0,0 +1,219 @@
+package firmware
+
+/* Verification of firmware images before flashing.
+
+Images are signed with the same key as driver releases, either directly with a
+detached signature
+
+    openssl dgst -sha256 -sign checksumsign.private.pem controller-app.bin | openssl base64 -A -out controller-app.bin.sig
+
+or indirectly with a signed manifest stating the checksum of the image:
+
+    {"image": "controller-app.bin", "size": 181004, "sha256": "9f86d0…", "version": "3.9.0.0"}
+
+The size of the image must be plausible for the Senso controller. The memory
+map of the controller is not known to the driver, so a valid signature is all
+that is required of the content of an image.
+
+Images that fail verification are additionally checked to look like an ARM
+Cortex-M application starting with its vector table, to tell files that are no
+firmware at all apart from firmware with a missing or wrong signature. The check
+only relies on the ARMv7-M architecture, not on a specific part (ARMv7-M
+Architecture Reference Manual, ARM DDI 0403E):
+
+- The first entry of the vector table is the initial stack pointer, which lies in
+  the SRAM region of the default memory map, 0x20000000 to 0x3FFFFFFF (B3.1).
+- The second entry is the reset handler, which has bit 0 set as the processor
+  only executes Thumb instructions (B1.5.3).
+
+*/
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Copy of keys/checksumsign.public.pem
+const publicKeyPEM = `-----BEGIN PUBLIC KEY-----
+MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAELNhr0Q/CdCSKpFWPHQId9XmytCz1
+BNBcDMwHh8O5ZRvdW1Sh9t7tYDIZBW1b4/JNBOoRnjf6N5rTAT95rW7TAg==
+-----END PUBLIC KEY-----
+`
+
+// Bounds for the size of firmware images
+const minFirmwareSize = 1 << 10
+const maxFirmwareSize = 2 << 20
+
+// SRAM region of the ARMv7-M default memory map, the initial stack pointer may point just past its end
+const sramStart = 0x20000000
+const sramEnd = 0x40000000
+
+// Verification of an image against a signature or a signed manifest
+type Verification struct {
+	// Detached signature of the image
+	Signature []byte
+
+	// Manifest and its detached signature
+	Manifest          []byte
+	ManifestSignature []byte
+
+	// Key to verify signatures with, the embedded key is used if nil
+	PublicKey *ecdsa.PublicKey
+}
+
+// Manifest describing a firmware image
+type Manifest struct {
+	Image   string `json:"image"`
+	Size    int    `json:"size"`
+	Sha256  string `json:"sha256"`
+	Version string `json:"version"`
+}
+
+// ParsePublicKey parses a PEM encoded ECDSA public key
+func ParsePublicKey(pemData []byte) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an ECDSA public key")
+	}
+	return ecdsaKey, nil
+}
+
+// Verify that the image has a plausible size and is signed, directly or via a manifest.
+//
+// The manifest is returned if the image was verified with one. If the image can not be verified and does not look like
+// firmware (see CheckImage), that is reported instead of the reason verification failed.
+func Verify(image []byte, verification Verification) (*Manifest, error) {
+	err := checkSize(image)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := verifyImage(image, verification)
+	if err != nil {
+		if imageErr := CheckImage(image); imageErr != nil {
+			return nil, imageErr
+		}
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// verifyImage verifies the signature of the image or of its manifest
+func verifyImage(image []byte, verification Verification) (*Manifest, error) {
+	var err error
+
+	key := verification.PublicKey
+	if key == nil {
+		key, err = ParsePublicKey([]byte(publicKeyPEM))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid embedded public key: %v", err)
+		}
+	}
+
+	if verification.Manifest != nil {
+		err = verifySignature(key, verification.Manifest, verification.ManifestSignature)
+		if err != nil {
+			return nil, fmt.Errorf("Manifest signature invalid: %v", err)
+		}
+		var manifest Manifest
+		err = json.Unmarshal(verification.Manifest, &manifest)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid manifest: %v", err)
+		}
+		checksum := sha256.Sum256(image)
+		if manifest.Size != len(image) {
+			return nil, fmt.Errorf("Image has size %d, manifest states %d.", len(image), manifest.Size)
+		} else if hex.EncodeToString(checksum[:]) != manifest.Sha256 {
+			return nil, errors.New("Image checksum does not match manifest.")
+		}
+		return &manifest, nil
+	} else if verification.Signature != nil {
+		err = verifySignature(key, image, verification.Signature)
+		if err != nil {
+			return nil, fmt.Errorf("Image signature invalid: %v", err)
+		}
+		return nil, nil
+	}
+
+	return nil, errors.New("Image is neither signed nor described by a signed manifest.")
+}
+
+// checkSize checks that the size of the image is within the bounds for firmware images
+func checkSize(image []byte) error {
+	if len(image) < minFirmwareSize {
+		return fmt.Errorf("Image is too small (%d bytes), expected at least %d bytes.", len(image), minFirmwareSize)
+	} else if len(image) > maxFirmwareSize {
+		return fmt.Errorf("Image is too large (%d bytes), expected at most %d bytes.", len(image), maxFirmwareSize)
+	}
+	return nil
+}
+
+// CheckImage checks the size of the image and the start of its vector table against the ARMv7-M default memory map
+func CheckImage(image []byte) error {
+	if err := checkSize(image); err != nil {
+		return err
+	}
+
+	// The vector table starts with the initial stack pointer, which must lie in
+	// SRAM, followed by the reset handler, which must be a Thumb address.
+	stackPointer := binary.LittleEndian.Uint32(image[0:])
+	resetHandler := binary.LittleEndian.Uint32(image[4:])
+	if stackPointer <= sramStart || stackPointer > sramEnd {
+		return fmt.Errorf("Image does not start with a Cortex-M vector table: initial stack pointer 0x%08X is outside of the SRAM region 0x%08X-0x%08X.", stackPointer, sramStart, sramEnd-1)
+	} else if resetHandler&1 != 1 {
+		return fmt.Errorf("Image does not start with a Cortex-M vector table: reset handler 0x%08X does not have the Thumb bit set.", resetHandler)
+	}
+
+	return nil
+}
+
+// verifySignature verifies an ECDSA signature over the SHA-256 digest of data.
+//
+// The signature is DER encoded, as written by `openssl dgst -sign`, optionally base64 encoded.
+func verifySignature(key *ecdsa.PublicKey, data []byte, signature []byte) error {
+	if len(signature) == 0 {
+		return errors.New("signature missing")
+	}
+
+	der := signature
+	decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(signature)))
+	if err == nil {
+		der = decoded
+	}
+
+	var ecdsaSignature struct {
+		R, S *big.Int
+	}
+	rest, err := asn1.Unmarshal(der, &ecdsaSignature)
+	if err != nil {
+		return fmt.Errorf("malformed signature: %v", err)
+	} else if len(rest) > 0 {
+		return errors.New("malformed signature: trailing data")
+	}
+
+	digest := sha256.Sum256(data)
+	if !ecdsa.Verify(key, digest[:], ecdsaSignature.R, ecdsaSignature.S) {
+		return errors.New("signature does not match")
+	}
+
+	return nil
+}
@@ -0,0 +1,192 @@
+package firmware
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// firmwareImage returns an image starting with the given vector table entries
+func firmwareImage(stackPointer uint32, resetHandler uint32) []byte {
+	image := make([]byte, minFirmwareSize)
+	binary.LittleEndian.PutUint32(image[0:], stackPointer)
+	binary.LittleEndian.PutUint32(image[4:], resetHandler)
+	return image
+}
+
+func sha256Hex(data []byte) string {
+	checksum := sha256.Sum256(data)
+	return hex.EncodeToString(checksum[:])
+}
+
+func sign(t *testing.T, key *ecdsa.PrivateKey, data []byte) []byte {
+	digest := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestCheckImage(t *testing.T) {
+	tests := []struct {
+		name  string
+		image []byte
+		err   string
+	}{
+		{
+			name:  "vector table",
+			image: firmwareImage(0x20008000, 0x00000411),
+		},
+		{
+			name:  "stack pointer at the end of SRAM",
+			image: firmwareImage(0x40000000, 0x00000411),
+		},
+		{
+			name:  "too small",
+			image: make([]byte, minFirmwareSize-1),
+			err:   "too small",
+		},
+		{
+			name:  "too large",
+			image: make([]byte, maxFirmwareSize+1),
+			err:   "too large",
+		},
+		{
+			name:  "zeros",
+			image: make([]byte, minFirmwareSize),
+			err:   "initial stack pointer 0x00000000 is outside of the SRAM region",
+		},
+		{
+			name:  "stack pointer in flash",
+			image: firmwareImage(0x08008000, 0x00000411),
+			err:   "initial stack pointer 0x08008000 is outside of the SRAM region",
+		},
+		{
+			name:  "reset handler without Thumb bit",
+			image: firmwareImage(0x20008000, 0x00000410),
+			err:   "reset handler 0x00000410 does not have the Thumb bit set",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := CheckImage(test.image)
+			if test.err == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("got error %v, expected it to contain %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := firmwareImage(0x20008000, 0x00000411)
+	manifest := []byte(`{"image": "controller-app.bin", "size": 1024, "sha256": "` + sha256Hex(image) + `", "version": "3.9.0.0"}`)
+
+	tests := []struct {
+		name         string
+		image        []byte
+		verification Verification
+		version      string
+		err          string
+	}{
+		{
+			name:         "signed image",
+			image:        image,
+			verification: Verification{Signature: sign(t, key, image)},
+		},
+		{
+			name:         "signed manifest",
+			image:        image,
+			verification: Verification{Manifest: manifest, ManifestSignature: sign(t, key, manifest)},
+			version:      "3.9.0.0",
+		},
+		{
+			name:  "unsigned image",
+			image: image,
+			err:   "Image is neither signed nor described by a signed manifest.",
+		},
+		{
+			name:         "image signed with another key",
+			image:        image,
+			verification: Verification{Signature: sign(t, otherKey, image)},
+			err:          "Image signature invalid: signature does not match",
+		},
+		{
+			name:         "signature of another image",
+			image:        image,
+			verification: Verification{Signature: sign(t, key, firmwareImage(0x20008000, 0x00000413))},
+			err:          "Image signature invalid: signature does not match",
+		},
+		{
+			name:         "manifest of another image",
+			image:        firmwareImage(0x20008000, 0x00000413),
+			verification: Verification{Manifest: manifest, ManifestSignature: sign(t, key, manifest)},
+			err:          "Image checksum does not match manifest.",
+		},
+		{
+			name:         "signed image with stack pointer outside of the default SRAM region",
+			image:        firmwareImage(0x10008000, 0x00000411),
+			verification: Verification{Signature: sign(t, key, firmwareImage(0x10008000, 0x00000411))},
+		},
+		{
+			name:         "signed image without vector table",
+			image:        make([]byte, minFirmwareSize),
+			verification: Verification{Signature: sign(t, key, make([]byte, minFirmwareSize))},
+		},
+		{
+			name:         "signed image too small",
+			image:        make([]byte, minFirmwareSize-1),
+			verification: Verification{Signature: sign(t, key, make([]byte, minFirmwareSize-1))},
+			err:          "too small",
+		},
+		{
+			name:  "unsigned image without vector table",
+			image: make([]byte, minFirmwareSize),
+			err:   "Image does not start with a Cortex-M vector table",
+		},
+		{
+			name:         "image without vector table signed with another key",
+			image:        make([]byte, minFirmwareSize),
+			verification: Verification{Signature: sign(t, otherKey, make([]byte, minFirmwareSize))},
+			err:          "Image does not start with a Cortex-M vector table",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.verification.PublicKey = &key.PublicKey
+			verified, err := Verify(test.image, test.verification)
+			if test.err == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("got error %v, expected it to contain %q", err, test.err)
+			}
+			if test.version != "" && (verified == nil || verified.Version != test.version) {
+				t.Errorf("got manifest %v, expected version %s", verified, test.version)
+			}
+		})
+	}
+}
@@ -0,0 +1,336 @@
+package firmware
+
+/* Service for updating the firmware of Senso from the running driver.
+
+A firmware update is started by posting a multipart form to
+
+    /firmware/update
+
+with the image in the `image` field and optionally the `serial` or `address`
+of the Senso to update. Only one update can run at a time.
+
+The image is verified before the update starts (see `verify.go`). Its detached
+signature is expected in the `signature` field, alternatively a manifest and
+its signature can be given in the `manifest` and `manifestSignature` fields.
+Unverified images are always refused, flashing them is only possible with the
+`update-firmware` subcommand.
+
+After the transfer, the update waits for Senso to return and compares its
+firmware version with the version stated in the manifest or given in the
+`expectVersion` field. Without either, the version must have changed.
+
+Progress of the update is streamed to clients of the WebSocket at
+
+    /firmware
+
+and the latest progress can be retrieved with a GET request to
+`/firmware/update`.
+
+*/
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cskr/pubsub"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dividat/driver/src/dividat-driver/senso/protocol"
+)
+
+const progressTopic = "progress"
+
+// Upper bound for the size of uploaded firmware images
+const maxImageSize = 16 << 20
+
+// Config of firmware updates from the running driver
+type Config struct {
+	// Key to verify signatures of images with, the embedded key is used if nil
+	PublicKey *ecdsa.PublicKey
+}
+
+// Handle for firmware updates
+type Handle struct {
+	broker *pubsub.PubSub
+	config Config
+
+	ctx context.Context
+
+	running bool
+	latest  *Progress
+	mutex   *sync.Mutex
+
+	log *logrus.Entry
+}
+
+// NewHandle returns a handle for firmware updates
+func NewHandle(ctx context.Context, log *logrus.Entry, config Config) *Handle {
+	handle := Handle{
+		broker: pubsub.New(32),
+		config: config,
+		ctx:    ctx,
+		mutex:  &sync.Mutex{},
+		log:    log,
+	}
+
+	// Clean up
+	go func() {
+		<-ctx.Done()
+		handle.broker.Shutdown()
+	}()
+
+	return &handle
+}
+
+// startUpdate runs an update in the background, returns false if an update is already running
+func (handle *Handle) startUpdate(image []byte, deviceSerial *string, address string, expectedVersion *protocol.Version) bool {
+	handle.mutex.Lock()
+	defer handle.mutex.Unlock()
+
+	if handle.running {
+		return false
+	}
+	handle.running = true
+	handle.latest = nil
+
+	go Update(handle.ctx, image, deviceSerial, &address, expectedVersion, handle.onProgress)
+
+	return true
+}
+
+func (handle *Handle) onProgress(progress Progress) {
+	handle.log.WithField("stage", progress.Stage).Info(progress.Message)
+
+	handle.mutex.Lock()
+	handle.latest = &progress
+	if progress.IsFinal() {
+		handle.running = false
+	}
+	handle.mutex.Unlock()
+
+	handle.broker.TryPub(Message{Progress: &progress}, progressTopic)
+}
+
+// getLatest returns the latest progress, nil if no update has been started
+func (handle *Handle) getLatest() *Progress {
+	handle.mutex.Lock()
+	defer handle.mutex.Unlock()
+	return handle.latest
+}
+
+// Message that can be sent to Play
+type Message struct {
+	Progress *Progress
+}
+
+// MarshalJSON implements json.Marshaler
+func (message Message) MarshalJSON() ([]byte, error) {
+	if message.Progress != nil {
+		return json.Marshal(&struct {
+			Type string `json:"type"`
+			*Progress
+		}{
+			Type:     "Progress",
+			Progress: message.Progress,
+		})
+	}
+
+	return nil, errors.New("could not marshal message")
+}
+
+// HTTP
+
+// ServeHTTP implements http.Handler
+func (handle *Handle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" && r.URL.Path == "/firmware/update" {
+		handle.ServeUpdate(w, r)
+	} else if r.Method == "GET" && r.URL.Path == "/firmware/update" {
+		handle.ServeProgress(w, r)
+	} else if r.URL.Path == "/firmware" || r.URL.Path == "/firmware/" {
+		handle.StreamProgress(w, r)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+// ServeUpdate starts an update with the posted image
+func (handle *Handle) ServeUpdate(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageSize+1<<20)
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		http.Error(w, "Missing firmware image: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	image, err := ioutil.ReadAll(io.LimitReader(file, maxImageSize+1))
+	if err != nil {
+		http.Error(w, "Could not read firmware image: "+err.Error(), http.StatusBadRequest)
+		return
+	} else if len(image) > maxImageSize {
+		http.Error(w, "Firmware image too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	verification := Verification{
+		Signature:         formBytes(r, "signature"),
+		Manifest:          formBytes(r, "manifest"),
+		ManifestSignature: formBytes(r, "manifestSignature"),
+		PublicKey:         handle.config.PublicKey,
+	}
+	manifest, err := Verify(image, verification)
+	if err != nil {
+		http.Error(w, "Could not verify firmware image: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	expectedVersion, err := ExpectedVersion(r.FormValue("expectVersion"), manifest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var deviceSerial *string
+	if serial := r.FormValue("serial"); serial != "" {
+		deviceSerial = &serial
+	}
+
+	if !handle.startUpdate(image, deviceSerial, r.FormValue("address"), expectedVersion) {
+		http.Error(w, "Firmware update already in progress", http.StatusConflict)
+		return
+	}
+
+	handle.log.WithField("bytes", len(image)).Info("Firmware update started.")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// formBytes returns the contents of a form field given as a file or as a value, nil if the field is missing
+func formBytes(r *http.Request, name string) []byte {
+	file, _, err := r.FormFile(name)
+	if err == nil {
+		defer file.Close()
+		data, err := ioutil.ReadAll(io.LimitReader(file, maxImageSize))
+		if err == nil {
+			return data
+		}
+	}
+	if value := r.FormValue(name); value != "" {
+		return []byte(value)
+	}
+	return nil
+}
+
+// ServeProgress responds with the latest progress, null if no update has been started
+func (handle *Handle) ServeProgress(w http.ResponseWriter, r *http.Request) {
+	progressJson, _ := json.Marshal(handle.getLatest())
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(progressJson)
+}
+
+// StreamProgress sends progress of updates to a WebSocket client
+func (handle *Handle) StreamProgress(w http.ResponseWriter, r *http.Request) {
+	// Set up logger
+	var log = handle.log.WithFields(logrus.Fields{
+		"clientAddress": r.RemoteAddr,
+		"userAgent":     r.UserAgent(),
+	})
+
+	// Upgrade to WebSocket
+	conn, err := webSocketUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.WithError(err).Error("Could not upgrade connection to WebSocket.")
+		http.Error(w, "WebSocket upgrade error", http.StatusBadRequest)
+		return
+	}
+
+	log.Info("WebSocket connection opened")
+
+	// Create a mutex for writing to WebSocket (connection supports only one concurrent reader and one concurrent writer (https://godoc.org/github.com/gorilla/websocket#hdr-Concurrency))
+	writeMutex := sync.Mutex{}
+
+	// Create a context for this WebSocket connection
+	ctx, cancel := context.WithCancel(context.Background())
+
+	send := func(message Message) error {
+		writeMutex.Lock()
+		conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+		err := conn.WriteJSON(&message)
+		writeMutex.Unlock()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.WithError(err).Error("WebSocket error")
+			}
+			return err
+		}
+		return nil
+	}
+
+	// Subscribe before sending the latest progress, so that no progress is missed
+	rx := handle.broker.Sub(progressTopic)
+	if latest := handle.getLatest(); latest != nil {
+		send(Message{Progress: latest})
+	}
+	go rx_progress_loop(ctx, rx, send)
+
+	// Helper function to close the connection
+	close := func() {
+		handle.broker.Unsub(rx)
+
+		// Cancel the context
+		cancel()
+
+		// Close websocket connection
+		conn.Close()
+
+		log.Info("WebSocket connection closed")
+	}
+
+	// Main loop for the WebSocket connection
+	go func() {
+		defer close()
+		for {
+			_, _, err := conn.ReadMessage()
+			if err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+					log.WithError(err).Error("WebSocket error")
+				}
+				return
+			}
+		}
+	}()
+}
+
+func rx_progress_loop(ctx context.Context, rx chan interface{}, send func(Message) error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case i, more := <-rx:
+			if !more {
+				return
+			}
+			message, ok := i.(Message)
+			if ok && send(message) != nil {
+				return
+			}
+		}
+	}
+}
+
+// Helper to upgrade http to WebSocket
+var webSocketUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
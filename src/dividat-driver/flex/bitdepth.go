@@ -0,0 +1,42 @@
+package flex
+
+/* Bit depth of samples.
+
+The length of samples depends on the bit depth (see the protocol package). As
+the parser needs to know the length of samples, the bit depth is changed by the
+driver between two measurement sets: the device command is written after a set
+has been received, before the next set is requested.
+
+Clients select the bit depth with the `SetBitDepth` command. Device commands
+changing the bit depth that are sent as binary messages are intercepted and
+handled like `SetBitDepth`, so that the parser can not lose track of samples.
+Other commands in the same message are still written to the device.
+
+*/
+
+import (
+	"fmt"
+
+	"github.com/dividat/driver/src/dividat-driver/flex/protocol"
+)
+
+// SetBitDepth selects the bit depth of samples, applied by the device connection before the next measurement set
+func (handle *Handle) SetBitDepth(bitDepth int) error {
+	if _, ok := protocol.BitDepthCommand(bitDepth); !ok {
+		return fmt.Errorf("unsupported bit depth %d, expected one of %v", bitDepth, protocol.SupportedBitDepths())
+	}
+
+	handle.bitDepthMutex.Lock()
+	handle.bitDepth = bitDepth
+	handle.bitDepthMutex.Unlock()
+
+	handle.log.WithField("bitDepth", bitDepth).Info("Selected bit depth.")
+	return nil
+}
+
+// BitDepth returns the bit depth selected by clients
+func (handle *Handle) BitDepth() int {
+	handle.bitDepthMutex.Lock()
+	defer handle.bitDepthMutex.Unlock()
+	return handle.bitDepth
+}
@@ -0,0 +1,251 @@
+package flex
+
+/* Connections to several devices at the same time.
+
+Every matching serial port is handled in its own goroutine, so that setups with
+several mats can be used concurrently. Devices are identified by the name of
+their serial port, or by the replay URL of a replayed recording.
+
+Measurement sets and frames of a device are published on topics of the device
+(`flex-rx/<id>` and `flex-frames/<id>`). Frames are also published on the topic
+of all devices (`flex-frames`), as they tell which device they come from. Raw
+measurement sets do not, so only the sets of the primary device are published
+on `flex-rx`: the device that has been connected the longest. Clients that do
+not subscribe to a device thus keep receiving the sets of a single device when
+further devices are connected. Subscribers use either topic, never both.
+
+Commands are published on `flex-tx/<id>` for a single device and on `flex-tx`
+for all devices. Clients that do not subscribe to a device send commands to the
+primary device, or to all devices while none is connected.
+
+Recordings contain the packets of the primary device.
+
+Every device has its own status, frame counter and frame dimensions. The status
+of the connection as a whole is derived from the statuses of the devices.
+
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/dividat/driver/src/dividat-driver/flex/protocol"
+	"github.com/dividat/driver/src/dividat-driver/recording"
+)
+
+// device is the connection to a single device
+type device struct {
+	id string
+	// Context of the connection the device belongs to
+	ctx context.Context
+	// Whether a goroutine is handling the device
+	active bool
+	status Status
+	// Increases with every connection of a device, orders the connected devices
+	connection uint64
+}
+
+// deviceTopic returns the topic of a single device, or of all devices if id is empty
+func deviceTopic(topic string, id string) string {
+	if id == "" {
+		return topic
+	}
+	return topic + "/" + id
+}
+
+// startDevice registers the device for the connection of ctx, returns nil if it is being handled already
+func (handle *Handle) startDevice(ctx context.Context, id string) *device {
+	handle.devicesMutex.Lock()
+	defer handle.devicesMutex.Unlock()
+
+	if existing, ok := handle.devices[id]; ok && existing.active && existing.ctx.Err() == nil {
+		return nil
+	}
+	dev := &device{id: id, ctx: ctx, active: true}
+	handle.devices[id] = dev
+	return dev
+}
+
+// runDevice calls connect with the callbacks and commands of the device, and returns once the connection to the device has ended
+func (handle *Handle) runDevice(dev *device, connect func(tx chan interface{}, onReceive func([]byte), onBitDepth func(int), onStatus func(Status))) {
+	decoder := newFrameDecoder()
+	var frameCounter uint32
+
+	onReceive := func(data []byte) {
+		if handle.isPrimary(dev) {
+			handle.recorder.Record(recording.DirectionRx, data)
+			handle.broker.TryPub(data, "flex-rx", deviceTopic("flex-rx", dev.id))
+		} else {
+			handle.broker.TryPub(data, deviceTopic("flex-rx", dev.id))
+		}
+
+		frame, err := decoder.decode(data, time.Now())
+		if err != nil {
+			handle.log.WithField("device", dev.id).WithError(err).Debug("Could not decode measurement set.")
+			return
+		}
+		frame.Device = dev.id
+		frame.Counter = frameCounter
+		frameCounter++
+		handle.broker.TryPub(frame, "flex-frames", deviceTopic("flex-frames", dev.id))
+	}
+
+	// Called by the device connection before receiving sets of another bit depth
+	onBitDepth := func(bitDepth int) {
+		decoder.bitDepth = bitDepth
+		// Recorded where the device changes, so that the following sets of the recording can be decoded
+		if command, ok := protocol.BitDepthCommand(bitDepth); ok && handle.isPrimary(dev) {
+			handle.recorder.Record(recording.DirectionTx, command)
+		}
+	}
+
+	onStatus := func(status Status) {
+		handle.setDeviceStatus(dev, status)
+	}
+
+	tx := handle.broker.Sub("flex-tx", deviceTopic("flex-tx", dev.id))
+	connect(tx, onReceive, onBitDepth, onStatus)
+
+	// The broker stops handling requests once it has been shut down
+	if handle.ctx.Err() == nil {
+		handle.broker.Unsub(tx)
+	}
+
+	handle.devicesMutex.Lock()
+	dev.active = false
+	// Devices of a connection that has been cancelled are forgotten
+	if dev.ctx.Err() != nil && handle.devices[dev.id] == dev {
+		delete(handle.devices, dev.id)
+	}
+	handle.devicesMutex.Unlock()
+}
+
+// forgetDevices removes devices that are no longer being handled, unless keep returns true
+func (handle *Handle) forgetDevices(keep func(*device) bool) {
+	handle.devicesMutex.Lock()
+	defer handle.devicesMutex.Unlock()
+
+	for id, dev := range handle.devices {
+		if !dev.active && !keep(dev) {
+			delete(handle.devices, id)
+		}
+	}
+}
+
+// setDeviceStatus records the status of a device, notifies subscribers and updates the status of the connection
+func (handle *Handle) setDeviceStatus(dev *device, status Status) {
+	handle.devicesMutex.Lock()
+	defer handle.devicesMutex.Unlock()
+
+	// Devices of a connection that has been cancelled no longer report their status
+	if dev.ctx.Err() != nil {
+		return
+	}
+	if status.State == StateConnected && dev.status.State != StateConnected {
+		handle.connections++
+		dev.connection = handle.connections
+	}
+	status.Device = dev.id
+	dev.status = status
+	handle.broker.TryPub(&status, "flex-status")
+
+	// The port is only given while it is unambiguous
+	connected := handle.connectedDevices()
+	if len(connected) == 1 {
+		handle.setStatus(Status{State: StateConnected, Port: connected[0].status.Port})
+	} else if len(connected) > 1 {
+		handle.setStatus(Status{State: StateConnected})
+	} else if status.State == StateDisconnected {
+		handle.setStatus(Status{State: StateDisconnected, Reason: status.Reason})
+	}
+}
+
+// setScanning reports looking for devices, unless a device is connected
+func (handle *Handle) setScanning(ctx context.Context) {
+	handle.devicesMutex.Lock()
+	defer handle.devicesMutex.Unlock()
+
+	if ctx.Err() == nil && len(handle.connectedDevices()) == 0 {
+		handle.setStatus(Status{State: StateScanning})
+	}
+}
+
+// primaryDevice returns the primary device, nil if no device is connected, devicesMutex must be held.
+//
+// The primary device stays the same while it is connected, otherwise the device that has been connected the longest
+// becomes the primary device.
+func (handle *Handle) primaryDevice() *device {
+	if primary, ok := handle.devices[handle.primary]; ok && primary.ctx.Err() == nil && primary.status.State == StateConnected {
+		return primary
+	}
+
+	var primary *device
+	for _, dev := range handle.connectedDevices() {
+		if primary == nil || dev.connection < primary.connection {
+			primary = dev
+		}
+	}
+	handle.primary = ""
+	if primary != nil {
+		handle.primary = primary.id
+	}
+	return primary
+}
+
+// isPrimary returns true if dev is the primary device
+func (handle *Handle) isPrimary(dev *device) bool {
+	handle.devicesMutex.Lock()
+	defer handle.devicesMutex.Unlock()
+	return handle.primaryDevice() == dev
+}
+
+// PrimaryDevice returns the ID of the primary device, empty if no device is connected
+func (handle *Handle) PrimaryDevice() string {
+	handle.devicesMutex.Lock()
+	defer handle.devicesMutex.Unlock()
+	if primary := handle.primaryDevice(); primary != nil {
+		return primary.id
+	}
+	return ""
+}
+
+// connectedDevices returns the connected devices of the current connection, devicesMutex must be held
+func (handle *Handle) connectedDevices() []*device {
+	var connected []*device
+	for _, dev := range handle.devices {
+		if dev.ctx.Err() == nil && dev.status.State == StateConnected {
+			connected = append(connected, dev)
+		}
+	}
+	return connected
+}
+
+// Devices returns the statuses of the devices of the current connection, ordered by ID
+func (handle *Handle) Devices() []Status {
+	handle.devicesMutex.Lock()
+	defer handle.devicesMutex.Unlock()
+
+	primary := handle.primaryDevice()
+	statuses := []Status{}
+	for _, dev := range handle.devices {
+		if dev.ctx.Err() == nil && dev.status.State != "" {
+			status := dev.status
+			status.Primary = dev == primary
+			statuses = append(statuses, status)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Device < statuses[j].Device
+	})
+	return statuses
+}
+
+// ServeDevices responds with the statuses of the devices
+func (handle *Handle) ServeDevices(w http.ResponseWriter, r *http.Request) {
+	devicesJson, _ := json.Marshal(handle.Devices())
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(devicesJson)
+}
@@ -0,0 +1,111 @@
+package flex
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/dividat/driver/src/dividat-driver/recording"
+)
+
+// writeSets writes a recording of ten sets of a single sample with value, one every 10ms, and returns its path
+func writeSets(t *testing.T, dir string, value byte) string {
+	var entries []recording.Entry
+	for ix := 0; ix < 10; ix++ {
+		entries = append(entries, recording.Entry{Time: time.Duration(ix) * 10 * time.Millisecond, Direction: recording.DirectionRx, Data: []byte{0, 0, value}})
+	}
+	return writeRecording(t, filepath.Join(dir, string('a'+value)+".dat"), 0, entries)
+}
+
+// receiveSets returns the sets received on rx during duration
+func receiveSets(rx chan interface{}, duration time.Duration) [][]byte {
+	var sets [][]byte
+	timeout := time.After(duration)
+	for {
+		select {
+		case i := <-rx:
+			sets = append(sets, i.([]byte))
+		case <-timeout:
+			return sets
+		}
+	}
+}
+
+// drain discards the sets buffered in rx
+func drain(rx chan interface{}) {
+	for {
+		select {
+		case <-rx:
+		default:
+			return
+		}
+	}
+}
+
+func TestPrimaryDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dividat-driver-flex-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The first device stops after 100ms, the second keeps replaying
+	first := "replay://" + writeSets(t, dir, 1) + "?loop=false"
+	second := "replay://" + writeSets(t, dir, 2)
+	data := map[string][]byte{first: []byte{0, 0, 1}, second: []byte{0, 0, 2}}
+
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handle := New(ctx, logrus.NewEntry(log), Config{Sources: []string{first, second}})
+	rx := handle.broker.Sub("flex-rx")
+	secondRx := handle.broker.Sub(deviceTopic("flex-rx", second))
+	handle.Connect()
+
+	// Sets of both devices are replayed, but only the sets of one device are published for clients not subscribing to a device
+	sets := receiveSets(rx, 80*time.Millisecond)
+	primary := handle.PrimaryDevice()
+	if data[primary] == nil {
+		t.Fatalf("primary device is %q, expected one of the sources", primary)
+	}
+	if len(sets) == 0 {
+		t.Fatal("received no sets")
+	}
+	for _, set := range sets {
+		if !bytes.Equal(set, data[primary]) {
+			t.Fatalf("received set %v, expected only sets of %s", set, primary)
+		}
+	}
+
+	// Once the first device has stopped, the second device is the primary device
+	time.Sleep(200 * time.Millisecond)
+	drain(rx)
+	sets = receiveSets(rx, 50*time.Millisecond)
+	if primary := handle.PrimaryDevice(); primary != second {
+		t.Fatalf("primary device is %q, expected %q", primary, second)
+	}
+	if len(sets) == 0 {
+		t.Fatal("received no sets of the second device")
+	}
+	for _, set := range sets {
+		if !bytes.Equal(set, data[second]) {
+			t.Fatalf("received set %v, expected only sets of %s", set, second)
+		}
+	}
+
+	// Sets of a device are published on its own topic, whether it is the primary device or not
+	if len(receiveSets(secondRx, 50*time.Millisecond)) == 0 {
+		t.Error("received no sets on the topic of the second device")
+	}
+
+	handle.broker.Unsub(rx)
+	handle.broker.Unsub(secondRx)
+}
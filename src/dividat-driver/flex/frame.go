@@ -0,0 +1,154 @@
+package flex
+
+/* Decoding of measurement sets into frames.
+
+A measurement set is a list of samples: row, column and value (see
+`protocol/bitdepth.go`). Sets may only contain some points of the mat, so they are
+decoded into a dense matrix, with zero for points without a sample. The
+dimensions of the matrix are given by the largest row and column seen since
+connecting to the device, so they grow until every row and column has been
+seen once.
+
+Frames can be sent to clients as JSON or in a compact binary layout (all
+integers little-endian):
+
+    counter    uint32   frame counter, increasing by one with every frame of the device
+    timestamp  uint64   time the set was received, in ms since the Unix epoch
+    rows       uint16
+    columns    uint16
+    bitDepth   uint16   bit depth of the values
+    idLength   uint16   length of the device ID
+    device              ID of the device (see `device.go`), UTF-8
+    values              rows * columns values, row by row, uint8 for a bit
+                        depth of 8, uint16 for higher bit depths
+
+*/
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dividat/driver/src/dividat-driver/flex/protocol"
+)
+
+// Length of the header of the binary layout of frames, followed by the device ID
+const frameHeaderLength = 4 + 8 + 2 + 2 + 2 + 2
+
+// Frame is a measurement set decoded into a matrix
+type Frame struct {
+	// ID of the device the set was received from
+	Device string
+	// Increases by one with every decoded frame of the device
+	Counter uint32
+	// Time the set was received
+	Timestamp time.Time
+	Rows      int
+	Columns   int
+	BitDepth  int
+	// Values row by row
+	Values []uint16
+}
+
+// frameDecoder keeps the dimensions of the matrix and the bit depth for the sets of a device connection
+type frameDecoder struct {
+	rows     int
+	columns  int
+	bitDepth int
+}
+
+func newFrameDecoder() *frameDecoder {
+	return &frameDecoder{bitDepth: protocol.DefaultBitDepth}
+}
+
+// decode a measurement set into a frame, without device and counter
+func (decoder *frameDecoder) decode(data []byte, timestamp time.Time) (*Frame, error) {
+	sampleLength, ok := protocol.SampleLength(decoder.bitDepth)
+	if !ok {
+		return nil, fmt.Errorf("measurement set has unsupported bit depth %d", decoder.bitDepth)
+	} else if len(data)%sampleLength != 0 {
+		return nil, fmt.Errorf("measurement set has length %d, expected a multiple of %d", len(data), sampleLength)
+	}
+
+	for offset := 0; offset < len(data); offset += sampleLength {
+		if row := int(data[offset]) + 1; row > decoder.rows {
+			decoder.rows = row
+		}
+		if column := int(data[offset+1]) + 1; column > decoder.columns {
+			decoder.columns = column
+		}
+	}
+
+	frame := Frame{
+		Timestamp: timestamp,
+		Rows:      decoder.rows,
+		Columns:   decoder.columns,
+		BitDepth:  decoder.bitDepth,
+		Values:    make([]uint16, decoder.rows*decoder.columns),
+	}
+	for offset := 0; offset < len(data); offset += sampleLength {
+		row, column := int(data[offset]), int(data[offset+1])
+		frame.Values[row*frame.Columns+column] = uint16(data[offset+2])
+	}
+
+	return &frame, nil
+}
+
+// Encode the frame into its binary layout
+func (frame *Frame) Encode() []byte {
+	valueLength := 1
+	if frame.BitDepth > 8 {
+		valueLength = 2
+	}
+
+	data := make([]byte, frameHeaderLength+len(frame.Device)+len(frame.Values)*valueLength)
+	binary.LittleEndian.PutUint32(data[0:], frame.Counter)
+	binary.LittleEndian.PutUint64(data[4:], uint64(frame.Timestamp.UnixNano()/int64(time.Millisecond)))
+	binary.LittleEndian.PutUint16(data[12:], uint16(frame.Rows))
+	binary.LittleEndian.PutUint16(data[14:], uint16(frame.Columns))
+	binary.LittleEndian.PutUint16(data[16:], uint16(frame.BitDepth))
+	binary.LittleEndian.PutUint16(data[18:], uint16(len(frame.Device)))
+	copy(data[frameHeaderLength:], frame.Device)
+
+	values := data[frameHeaderLength+len(frame.Device):]
+	for ix, value := range frame.Values {
+		if valueLength == 1 {
+			values[ix] = uint8(value)
+		} else {
+			binary.LittleEndian.PutUint16(values[ix*2:], value)
+		}
+	}
+	return data
+}
+
+// MarshalJSON implements encoding/json Marshaler interface
+func (frame *Frame) MarshalJSON() ([]byte, error) {
+	matrix := make([][]int, frame.Rows)
+	for row := range matrix {
+		matrix[row] = make([]int, frame.Columns)
+		for column := range matrix[row] {
+			matrix[row][column] = int(frame.Values[row*frame.Columns+column])
+		}
+	}
+
+	return json.Marshal(&struct {
+		Type      string  `json:"type"`
+		Device    string  `json:"device"`
+		Counter   uint32  `json:"counter"`
+		Timestamp int64   `json:"timestamp"`
+		Rows      int     `json:"rows"`
+		Columns   int     `json:"columns"`
+		BitDepth  int     `json:"bitDepth"`
+		Matrix    [][]int `json:"matrix"`
+	}{
+		Type:      "Frame",
+		Device:    frame.Device,
+		Counter:   frame.Counter,
+		Timestamp: frame.Timestamp.UnixNano() / int64(time.Millisecond),
+		Rows:      frame.Rows,
+		Columns:   frame.Columns,
+		BitDepth:  frame.BitDepth,
+		Matrix:    matrix,
+	})
+}
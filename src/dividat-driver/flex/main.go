@@ -7,23 +7,35 @@ This helps establish an indirect WebSocket connection to receive a stream of sam
 The functionality of this module is as follows:
 
 - While connected, scan for serial devices that look like a potential Flex device
-- Connect to suitable serial devices and start polling for measurements
+- Connect to each suitable serial device and start polling for measurements (see `device.go`)
+- Skip ports whose device did not answer the handshake, until the port disappears
 - Minimally parse incoming data to determine start and end of a measurement
 - Send each complete measurement set to client as a binary package
 
+Instead of serial devices, recordings can be replayed by configuring replay URLs
+as sources (see `replay.go`).
+
 */
 
 import (
 	"bufio"
 	"context"
 	"encoding/binary"
-	"strings"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cskr/pubsub"
 	"github.com/sirupsen/logrus"
 	"go.bug.st/serial"
 	"go.bug.st/serial/enumerator"
+
+	"github.com/dividat/driver/src/dividat-driver/flex/protocol"
+	"github.com/dividat/driver/src/dividat-driver/recording"
 )
 
 // Handle for managing SensingTex connection
@@ -35,17 +47,61 @@ type Handle struct {
 	cancelCurrentConnection context.CancelFunc
 	subscriberCount         int
 
+	// Status of the connection as a whole, guarded by statusMutex
+	status      Status
+	statusMutex *sync.Mutex
+
+	// Devices of the connection by ID, guarded by devicesMutex, which is acquired before statusMutex
+	devices      map[string]*device
+	devicesMutex *sync.Mutex
+	// ID of the primary device and number of times a device has connected, guarded by devicesMutex (see `device.go`)
+	primary     string
+	connections uint64
+	// Ports whose device did not answer the handshake, skipped until they disappear, guarded by devicesMutex
+	rejected map[rejectedPort]bool
+
+	// Records packets sent and received
+	recorder *recording.Recorder
+
+	// Bit depth selected by clients, guarded by bitDepthMutex
+	bitDepth      int
+	bitDepthMutex *sync.Mutex
+
+	config Config
+
 	log *logrus.Entry
 }
 
+// Config for the Flex handle
+type Config struct {
+	// Replay URLs of recordings to replay in place of serial devices, serial devices are used if empty
+	Sources []string
+	// Rules selecting serial ports of devices, DefaultPortMatchers if empty
+	Ports []PortMatcher
+	// Require devices to answer with a measurement set before they are considered connected
+	Probe bool
+	// Recording of the device stream
+	Recording recording.Config
+}
+
 // New returns an initialized handler
-func New(ctx context.Context, log *logrus.Entry) *Handle {
+func New(ctx context.Context, log *logrus.Entry, config Config) *Handle {
 	handle := Handle{
-		broker: pubsub.New(32),
-		ctx:    ctx,
-		log:    log,
+		broker:        pubsub.New(32),
+		ctx:           ctx,
+		status:        Status{State: StateIdle},
+		statusMutex:   &sync.Mutex{},
+		devices:       make(map[string]*device),
+		devicesMutex:  &sync.Mutex{},
+		rejected:      make(map[rejectedPort]bool),
+		bitDepth:      protocol.DefaultBitDepth,
+		bitDepthMutex: &sync.Mutex{},
+		config:        config,
+		log:           log,
 	}
 
+	handle.recorder = recording.NewRecorder(ctx, log, config.Recording, "flex", handle.describeRecording)
+
 	// Clean up
 	go func() {
 		<-ctx.Done()
@@ -63,31 +119,56 @@ func (handle *Handle) Connect() {
 	if handle.cancelCurrentConnection == nil {
 		ctx, cancel := context.WithCancel(handle.ctx)
 
-		onReceive := func(data []byte) {
-			handle.broker.TryPub(data, "flex-rx")
+		handle.setStatus(Status{State: StateScanning})
+		if len(handle.config.Sources) > 0 {
+			for _, source := range handle.config.Sources {
+				source := source
+				if dev := handle.startDevice(ctx, source); dev != nil {
+					go handle.runDevice(dev, func(tx chan interface{}, onReceive func([]byte), onBitDepth func(int), onStatus func(Status)) {
+						handle.replayLoop(ctx, source, tx, onReceive, onBitDepth, onStatus)
+					})
+				}
+			}
+		} else {
+			go handle.listeningLoop(ctx)
 		}
 
-		go listeningLoop(ctx, handle.log, handle.broker.Sub("flex-tx"), onReceive)
-
 		handle.cancelCurrentConnection = cancel
 	}
 }
 
+// describeRecording adds the bit depth and the serial number of the primary device, which is recorded, to the metadata of a recording
+func (handle *Handle) describeRecording(metadata *recording.Metadata) {
+	metadata.BitDepth = handle.BitDepth()
+
+	handle.devicesMutex.Lock()
+	defer handle.devicesMutex.Unlock()
+	if primary := handle.primaryDevice(); primary != nil && primary.status.Port != nil {
+		metadata.Serial = primary.status.Port.SerialNumber
+	}
+}
+
 // Deregister subscribers and disconnect when none left
 func (handle *Handle) DeregisterSubscriber() {
 	handle.subscriberCount--
 
 	if handle.subscriberCount == 0 && handle.cancelCurrentConnection != nil {
+		// Devices can not report their status in between cancelling and becoming idle
+		handle.devicesMutex.Lock()
 		handle.cancelCurrentConnection()
 		handle.cancelCurrentConnection = nil
+		handle.setStatus(Status{State: StateIdle})
+		handle.devicesMutex.Unlock()
+
+		handle.forgetDevices(func(*device) bool { return false })
 	}
 }
 
-// Keep looking for serial devices and connect to them when found, sending signals into the
-// callback.
-func listeningLoop(ctx context.Context, logger *logrus.Entry, tx chan interface{}, onReceive func([]byte)) {
+// Keep looking for serial devices and connect to them when found, until ctx is cancelled.
+func (handle *Handle) listeningLoop(ctx context.Context) {
 	for {
-		scanAndConnectSerial(ctx, logger, tx, onReceive)
+		handle.setScanning(ctx)
+		handle.scanAndConnectSerial(ctx)
 
 		// Terminate if we were cancelled
 		if ctx.Err() != nil {
@@ -98,9 +179,10 @@ func listeningLoop(ctx context.Context, logger *logrus.Entry, tx chan interface{
 	}
 }
 
-// One pass of browsing for serial devices and trying to connect to them turn by turn, first
-// successful connection wins.
-func scanAndConnectSerial(ctx context.Context, logger *logrus.Entry, tx chan interface{}, onReceive func([]byte)) {
+// One pass of browsing for serial devices, connecting to each matching port in its own goroutine
+// unless it is connected already.
+func (handle *Handle) scanAndConnectSerial(ctx context.Context) {
+	logger := handle.log
 	ports, err := enumerator.GetDetailedPortsList()
 	if err != nil {
 		logger.WithField("error", err).Info("Could not list serial devices.")
@@ -108,31 +190,114 @@ func scanAndConnectSerial(ctx context.Context, logger *logrus.Entry, tx chan int
 	}
 
 	for _, port := range ports {
+		logger.WithField("name", port.Name).WithField("vendor", port.VID).WithField("product", port.PID).Debug("Considering serial port.")
+	}
+
+	handle.connectPorts(ctx, ports)
+}
+
+// connectPorts connects to the listed ports matching the rules, that are not yet connected and have not failed the handshake
+func (handle *Handle) connectPorts(ctx context.Context, ports []*enumerator.PortDetails) {
+	logger := handle.log
+
+	matchers := handle.config.Ports
+	if len(matchers) == 0 {
+		matchers = DefaultPortMatchers
+	}
+	matched := matchPorts(matchers, ports)
+
+	// Disconnected devices are listed until their port disappears, ports failing the handshake are skipped until then
+	listed := make(map[string]bool)
+	for _, port := range ports {
+		listed[port.Name] = true
+	}
+	names := make(map[string]bool)
+	present := make(map[rejectedPort]bool)
+	for _, port := range matched {
+		names[port.Name] = true
+		if listed[port.Name] || portExists(port.Name) {
+			present[rejectedPortOf(port)] = true
+		}
+	}
+	handle.forgetDevices(func(dev *device) bool {
+		return names[dev.id]
+	})
+	handle.forgetRejected(present)
+
+	for _, port := range matched {
 		// Terminate if we have been cancelled
 		if ctx.Err() != nil {
 			return
 		}
 
-		logger.WithField("name", port.Name).WithField("vendor", port.VID).Debug("Considering serial port.")
-
-		if isFlexLike(port) {
-			connectSerial(ctx, logger, port.Name, tx, onReceive)
+		if handle.isRejected(port) {
+			continue
+		}
+		dev := handle.startDevice(ctx, port.Name)
+		if dev == nil {
+			continue
 		}
+		port := port
+		go handle.runDevice(dev, func(tx chan interface{}, onReceive func([]byte), onBitDepth func(int), onStatus func(Status)) {
+			err := connectSerial(ctx, logger, port, handle.config.Probe, tx, handle.BitDepth, onReceive, onBitDepth, onStatus)
+			if err == errNoHandshake {
+				logger.WithField("name", port.Name).WithField("serial", port.SerialNumber).Info("Ignoring port until it disappears.")
+				handle.rejectPort(port)
+			}
+			if ctx.Err() == nil {
+				onStatus(Status{State: StateDisconnected, Port: portOfDetails(port), Reason: err.Error()})
+			}
+		})
 	}
 }
 
-// Check whether a port looks like a potential Flex device.
-//
-// Vendor IDs:
-//   16C0 - Van Ooijen Technische Informatica (Teensy)
-func isFlexLike(port *enumerator.PortDetails) bool {
-	vendorId := strings.ToUpper(port.VID)
+// rejectedPort identifies a port whose device did not answer the handshake, by path and USB serial number
+type rejectedPort struct {
+	name         string
+	serialNumber string
+}
 
-	return vendorId == "16C0"
+func rejectedPortOf(port *enumerator.PortDetails) rejectedPort {
+	return rejectedPort{name: port.Name, serialNumber: port.SerialNumber}
+}
+
+// portExists tells whether there is a file at the path of a port that is not listed by the system
+func portExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+func (handle *Handle) rejectPort(port *enumerator.PortDetails) {
+	handle.devicesMutex.Lock()
+	defer handle.devicesMutex.Unlock()
+	handle.rejected[rejectedPortOf(port)] = true
+}
+
+func (handle *Handle) isRejected(port *enumerator.PortDetails) bool {
+	handle.devicesMutex.Lock()
+	defer handle.devicesMutex.Unlock()
+	return handle.rejected[rejectedPortOf(port)]
+}
+
+// forgetRejected forgets rejected ports that are no longer present, so that they are probed again when they reappear
+func (handle *Handle) forgetRejected(present map[rejectedPort]bool) {
+	handle.devicesMutex.Lock()
+	defer handle.devicesMutex.Unlock()
+	for port := range handle.rejected {
+		if !present[port] {
+			delete(handle.rejected, port)
+		}
+	}
 }
 
 // Serial communication
 
+// How long to wait for the first measurement set when probing a device
+const probeTimeout = 1 * time.Second
+
+// Returned by connectSerial if the device did not answer the handshake
+var errNoHandshake = errors.New("Device did not answer with a measurement set.")
+
 type ReaderState int
 
 const (
@@ -152,7 +317,12 @@ const (
 
 // Actually attempt to connect to an individual serial port and pipe its signal into the callback, summarizing
 // package units into a buffer.
-func connectSerial(ctx context.Context, logger *logrus.Entry, serialName string, tx chan interface{}, onReceive func([]byte)) {
+//
+// The bit depth requested with bitDepth is applied between sets, onBitDepth is called before sets of a new bit depth are received.
+// If probe is set, the device is only considered connected once it has sent a complete set within probeTimeout.
+// Returns why the connection failed or was lost, once the connection has ended.
+func connectSerial(ctx context.Context, logger *logrus.Entry, details *enumerator.PortDetails, probe bool, tx chan interface{}, bitDepth func() int, onReceive func([]byte), onBitDepth func(int), onStatus func(Status)) error {
+	serialName := details.Name
 	mode := &serial.Mode{
 		BaudRate: 115200,
 		Parity:   serial.NoParity,
@@ -166,7 +336,7 @@ func connectSerial(ctx context.Context, logger *logrus.Entry, serialName string,
 	port, err := serial.Open(serialName, mode)
 	if err != nil {
 		logger.WithField("config", mode).WithField("error", err).Info("Failed to open connection to serial port.")
-		return
+		return fmt.Errorf("Could not open %s: %v", serialName, err)
 	}
 	portCtx, portCtxCancel := context.WithCancel(ctx)
 	defer func() {
@@ -175,25 +345,66 @@ func connectSerial(ctx context.Context, logger *logrus.Entry, serialName string,
 		portCtxCancel()
 	}()
 
-	// We hardcode a bitdepth of 8 for sample acquisition.
-	// In principle this could be made configurable and left to the client.
-	// However, parsing of the byte stream requires knowing the bitdepth,
-	// so in order to assemble frame packages the driver would need to
-	// intercept client-to-device commands and configure the parser
-	// accordingly. As we don't need acquisition at other than 8 bits it
-	// seems more robust to fix the mode in the driver right now.
-	BYTES_PER_SAMPLE := 3 // Row, column and sample value of 8 bit
-	BITDEPTH_8_CMD := []byte{'U', 'L', '\n'}
-        _, err = port.Write(BITDEPTH_8_CMD)
+	// Parsing of the byte stream requires knowing the bitdepth, so the
+	// bitdepth is only changed here, between sets (see `bitdepth.go`).
+	var currentBitDepth int
+	var BYTES_PER_SAMPLE int
+	applyBitDepth := func() error {
+		requested := bitDepth()
+		if requested == currentBitDepth {
+			return nil
+		}
+		// Only supported bit depths can be selected (see `SetBitDepth`)
+		command, _ := protocol.BitDepthCommand(requested)
+		_, err := port.Write(command)
+		if err != nil {
+			logger.WithField("error", err).WithField("bitDepth", requested).Info("Failed to set bitdepth.")
+			return err
+		}
+		currentBitDepth = requested
+		BYTES_PER_SAMPLE, _ = protocol.SampleLength(requested)
+		onBitDepth(requested)
+		return nil
+	}
+
+	err = applyBitDepth()
 	if err != nil {
-		logger.WithField("error", err).Info("Failed to set bitdepth of 8.")
-		return
+		return fmt.Errorf("Could not set bit depth: %v", err)
 	}
 
 	_, err = port.Write(START_MEASUREMENT_CMD)
 	if err != nil {
 		logger.WithField("error", err).Info("Failed to write start message to serial port.")
-		return
+		return fmt.Errorf("Could not start measurement: %v", err)
+	}
+
+	onConnected := func() {
+		logger.WithField("name", serialName).Info("Connected.")
+		onStatus(Status{State: StateConnected, Port: portOfDetails(details)})
+	}
+
+	// Reading blocks, so the port is closed if the device does not answer in time
+	var probeTimer *time.Timer
+	var probeFailed int32
+	if probe {
+		logger.WithField("name", serialName).Debug("Waiting for handshake.")
+		probeTimer = time.AfterFunc(probeTimeout, func() {
+			atomic.StoreInt32(&probeFailed, 1)
+			port.Close()
+		})
+		defer probeTimer.Stop()
+	} else {
+		onConnected()
+	}
+
+	readFailed := func(err error) error {
+		if atomic.LoadInt32(&probeFailed) == 1 {
+			logger.WithField("name", serialName).Info("Device did not answer handshake.")
+			return errNoHandshake
+		} else if err == io.EOF {
+			return errors.New("Device disconnected.")
+		}
+		return fmt.Errorf("Could not read from device: %v", err)
 	}
 
 	reader := bufio.NewReader(port)
@@ -209,7 +420,10 @@ func connectSerial(ctx context.Context, logger *logrus.Entry, serialName string,
 			case <-portCtx.Done():
 				return
 
-			case i := <-tx:
+			case i, ok := <-tx:
+				if !ok {
+					return
+				}
 				data, _ := i.([]byte)
 				_, err = port.Write(data)
 				logger.WithField("bytes", data).Debug("Wrote binary command to serial out.")
@@ -222,12 +436,12 @@ func connectSerial(ctx context.Context, logger *logrus.Entry, serialName string,
 	for {
 		// Terminate if we were cancelled
 		if ctx.Err() != nil {
-			return
+			return nil
 		}
 
 		input, err := reader.ReadByte()
 		if err != nil {
-			return
+			return readFailed(err)
 		}
 
 		// Finite State Machine for parsing byte stream
@@ -242,7 +456,7 @@ func connectSerial(ctx context.Context, logger *logrus.Entry, serialName string,
 			msb := input
 			lsb, err := reader.ReadByte()
 			if err != nil {
-				return
+				return readFailed(err)
 			}
 			samplesLeftInSet = int(binary.BigEndian.Uint16([]byte{msb, lsb}))
 			state = WAITING_FOR_BODY
@@ -261,14 +475,22 @@ func connectSerial(ctx context.Context, logger *logrus.Entry, serialName string,
 
 				if samplesLeftInSet <= 0 {
 					// Finish and send set
+					if probeTimer != nil && probeTimer.Stop() {
+						probeTimer = nil
+						onConnected()
+					}
 					onReceive(buff)
 
 					// Get ready for next set and request it
 					state = WAITING_FOR_HEADER
+					err = applyBitDepth()
+					if err != nil {
+						return fmt.Errorf("Could not set bit depth: %v", err)
+					}
 					_, err = port.Write(START_MEASUREMENT_CMD)
 					if err != nil {
 						logger.WithField("error", err).Info("Failed to write poll message to serial port.")
-						return
+						return fmt.Errorf("Could not request measurement: %v", err)
 					}
 				} else {
 					// Start next point
@@ -0,0 +1,275 @@
+package flex
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+	"go.bug.st/serial/enumerator"
+
+	"github.com/dividat/driver/src/dividat-driver/flex/protocol"
+)
+
+// openPty opens a pseudo terminal, returning its master and the name of its slave, to be opened as a serial port
+func openPty(t *testing.T) (*os.File, string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("no pseudo terminals: %v", err)
+	}
+	var number uint32
+	var unlock int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&number))); errno != 0 {
+		master.Close()
+		t.Fatal(errno)
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		master.Close()
+		t.Fatal(errno)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", number)
+}
+
+// answerSets returns a device that answers every request for measurements with a set of two 8 bit samples, until
+// the pseudo terminal is closed. Received commands are passed to commands, unless it is nil.
+func answerSets(commands chan<- string) func(*os.File) {
+	return func(master *os.File) {
+		reader := bufio.NewReader(master)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if commands != nil {
+				commands <- line
+			}
+			if line == "S\n" {
+				master.Write([]byte{'N', '\n', 0, 2, 'P', '\n', 0, 0, 1, 1, 2, 200})
+			}
+		}
+	}
+}
+
+// ignoreRequests reads requests without answering, until the pseudo terminal is closed
+func ignoreRequests(master *os.File) {
+	ioutil.ReadAll(master)
+}
+
+// recordRequests returns a device that passes received commands to commands without answering, until the pseudo terminal is closed
+func recordRequests(commands chan<- string) func(*os.File) {
+	return func(master *os.File) {
+		reader := bufio.NewReader(master)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			commands <- line
+		}
+	}
+}
+
+func TestConnectSerialProbe(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+
+	tests := []struct {
+		name      string
+		device    func(*os.File)
+		connected bool
+	}{
+		{name: "device answering", device: answerSets(nil), connected: true},
+		{name: "device not answering", device: ignoreRequests},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			master, name := openPty(t)
+			defer master.Close()
+			go test.device(master)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			connected := make(chan bool, 1)
+			onStatus := func(status Status) {
+				if status.State == StateConnected {
+					connected <- true
+				}
+			}
+			onReceive := func(data []byte) {
+				// Stop after the first set
+				cancel()
+			}
+
+			started := time.Now()
+			err := connectSerial(ctx, logrus.NewEntry(log), &enumerator.PortDetails{Name: name}, true, make(chan interface{}), func() int { return protocol.DefaultBitDepth }, onReceive, func(int) {}, onStatus)
+			elapsed := time.Since(started)
+
+			if test.connected {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				if len(connected) != 1 {
+					t.Error("device was not reported as connected")
+				}
+			} else {
+				if err == nil || !strings.Contains(err.Error(), "did not answer") {
+					t.Errorf("got error %v, expected the handshake to fail", err)
+				}
+				if len(connected) != 0 {
+					t.Error("device was reported as connected")
+				}
+				if elapsed < probeTimeout || elapsed > 2*probeTimeout {
+					t.Errorf("handshake failed after %v, expected %v", elapsed, probeTimeout)
+				}
+			}
+		})
+	}
+}
+
+func TestConnectSerialBitDepth(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+
+	master, name := openPty(t)
+	defer master.Close()
+	commands := make(chan string, 64)
+	go answerSets(commands)(master)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var frames []*Frame
+	decoder := newFrameDecoder()
+	bitDepth := func() int {
+		return protocol.DefaultBitDepth
+	}
+	onBitDepth := func(bitDepth int) {
+		decoder.bitDepth = bitDepth
+	}
+	onReceive := func(data []byte) {
+		frame, err := decoder.decode(data, time.Now())
+		if err != nil {
+			t.Errorf("could not decode set %d: %v", len(frames), err)
+		} else {
+			frames = append(frames, frame)
+		}
+		if len(frames) == 2 || err != nil {
+			cancel()
+		}
+	}
+
+	err := connectSerial(ctx, logrus.NewEntry(log), &enumerator.PortDetails{Name: name}, false, make(chan interface{}), bitDepth, onReceive, onBitDepth, func(Status) {})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The bit depth is selected before measurements are requested, and only once
+	if first, second := <-commands, <-commands; first != "UL\n" || second != "S\n" {
+		t.Errorf("device received %q and %q, expected the bit depth command before the request", first, second)
+	}
+	if third := <-commands; third != "S\n" {
+		t.Errorf("device received %q, expected the next request", third)
+	}
+
+	if len(frames) != 2 {
+		t.Fatalf("decoded %d frames, expected 2", len(frames))
+	}
+	for ix, frame := range frames {
+		if frame.BitDepth != 8 || frame.Rows != 2 || frame.Columns != 3 {
+			t.Fatalf("frame %d has %dx%d values of bit depth %d, expected 2x3 of bit depth 8", ix, frame.Rows, frame.Columns, frame.BitDepth)
+		}
+		if frame.Values[0] != 1 || frame.Values[5] != 200 {
+			t.Errorf("frame %d has values %v, expected 1 and 200", ix, frame.Values)
+		}
+	}
+}
+
+func TestConnectPortsRejected(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+
+	master, name := openPty(t)
+	defer master.Close()
+	// Keep the pseudo terminal open between connections
+	slave, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slave.Close()
+	commands := make(chan string, 64)
+	go recordRequests(commands)(master)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	matcher, err := ParsePortMatcher("serial=^FLX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := New(ctx, logrus.NewEntry(log), Config{Ports: []PortMatcher{matcher}, Probe: true})
+
+	listed := func(serialNumber string) []*enumerator.PortDetails {
+		return []*enumerator.PortDetails{{Name: name, IsUSB: true, SerialNumber: serialNumber}}
+	}
+	// scan connects to the ports and waits until the connection to the device has ended, returning the received commands
+	scan := func(ports []*enumerator.PortDetails) []string {
+		handle.connectPorts(ctx, ports)
+		deadline := time.Now().Add(3 * probeTimeout)
+		for {
+			handle.devicesMutex.Lock()
+			dev, ok := handle.devices[name]
+			active := ok && dev.active
+			handle.devicesMutex.Unlock()
+			if !active {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("connection to the device did not end")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(100 * time.Millisecond)
+		var received []string
+		for len(commands) > 0 {
+			received = append(received, <-commands)
+		}
+		return received
+	}
+
+	if received := scan(listed("FLX1")); len(received) == 0 {
+		t.Fatal("device was not probed")
+	}
+	if !handle.isRejected(listed("FLX1")[0]) {
+		t.Fatal("port was not rejected after failing the handshake")
+	}
+
+	// Rejected ports are not opened again while they are listed
+	for i := 0; i < 2; i++ {
+		if received := scan(listed("FLX1")); len(received) != 0 {
+			t.Fatalf("rejected port was opened again, device received %q", received)
+		}
+	}
+
+	// Ports are probed again after their serial number changed
+	if received := scan(listed("FLX2")); len(received) == 0 {
+		t.Error("port with another serial number was not probed")
+	}
+
+	// Ports are probed again after they disappeared
+	scan(nil)
+	if handle.isRejected(listed("FLX2")[0]) {
+		t.Error("port was still rejected after it disappeared")
+	}
+	if received := scan(listed("FLX2")); len(received) == 0 {
+		t.Error("port was not probed again after it reappeared")
+	}
+}
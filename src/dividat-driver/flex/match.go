@@ -0,0 +1,119 @@
+package flex
+
+/* Selecting the serial ports of Flex devices.
+
+Serial ports are matched against a list of rules, a port is connected to if it
+matches any rule. Rules are given as comma separated conditions on the port,
+all of which must hold:
+
+    vid=16C0               USB vendor ID
+    pid=0483               USB product ID
+    serial=^FLX            regular expression matching the USB serial number
+    product=Flex           regular expression matching the product string
+    name=/dev/ttyACM0      path of the port
+
+Ports named by a rule without further conditions are connected to even if they
+are not listed by the system, like virtual serial ports.
+
+By default, any Teensy (vendor ID 16C0) is considered a Flex device.
+
+As other devices may match the rules, a handshake can be required: the device
+must answer the first request for measurements with a complete measurement set
+before it is considered connected. Ports failing the handshake are not opened
+again until they disappear, or their USB serial number changes.
+
+*/
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.bug.st/serial/enumerator"
+)
+
+// PortMatcher is a rule selecting serial ports, empty conditions match any port
+type PortMatcher struct {
+	Name         string
+	VID          string
+	PID          string
+	SerialNumber *regexp.Regexp
+	Product      *regexp.Regexp
+
+	spec string
+}
+
+// DefaultPortMatchers match any Teensy, vendor ID 16C0 (Van Ooijen Technische Informatica)
+var DefaultPortMatchers = []PortMatcher{PortMatcher{VID: "16C0", spec: "vid=16C0"}}
+
+// ParsePortMatcher parses a rule of comma separated conditions, like `vid=16C0,pid=0483`
+func ParsePortMatcher(spec string) (PortMatcher, error) {
+	matcher := PortMatcher{spec: spec}
+
+	for _, condition := range strings.Split(spec, ",") {
+		parts := strings.SplitN(condition, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return matcher, fmt.Errorf("invalid condition %q in port rule %q, expected key=value", condition, spec)
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+		var err error
+		switch key {
+		case "name":
+			matcher.Name = value
+		case "vid":
+			matcher.VID = strings.ToUpper(value)
+		case "pid":
+			matcher.PID = strings.ToUpper(value)
+		case "serial":
+			matcher.SerialNumber, err = regexp.Compile(value)
+		case "product":
+			matcher.Product, err = regexp.Compile(value)
+		default:
+			return matcher, fmt.Errorf("unknown condition %q in port rule %q, expected name, vid, pid, serial or product", key, spec)
+		}
+		if err != nil {
+			return matcher, fmt.Errorf("invalid pattern in port rule %q: %v", spec, err)
+		}
+	}
+
+	return matcher, nil
+}
+
+// Matches returns true if the port satisfies all conditions of the rule
+func (matcher PortMatcher) Matches(port *enumerator.PortDetails) bool {
+	return (matcher.Name == "" || matcher.Name == port.Name) &&
+		(matcher.VID == "" || matcher.VID == strings.ToUpper(port.VID)) &&
+		(matcher.PID == "" || matcher.PID == strings.ToUpper(port.PID)) &&
+		(matcher.SerialNumber == nil || matcher.SerialNumber.MatchString(port.SerialNumber)) &&
+		(matcher.Product == nil || matcher.Product.MatchString(port.Product))
+}
+
+func (matcher PortMatcher) String() string {
+	return matcher.spec
+}
+
+// matchPorts returns the listed ports matching any rule, followed by unlisted ports named by a rule without further conditions
+func matchPorts(matchers []PortMatcher, ports []*enumerator.PortDetails) []*enumerator.PortDetails {
+	var matched []*enumerator.PortDetails
+	listed := make(map[string]bool)
+	for _, port := range ports {
+		listed[port.Name] = true
+		for _, matcher := range matchers {
+			if matcher.Matches(port) {
+				matched = append(matched, port)
+				break
+			}
+		}
+	}
+
+	for _, matcher := range matchers {
+		onlyName := matcher.VID == "" && matcher.PID == "" && matcher.SerialNumber == nil && matcher.Product == nil
+		if matcher.Name != "" && onlyName && !listed[matcher.Name] {
+			listed[matcher.Name] = true
+			matched = append(matched, &enumerator.PortDetails{Name: matcher.Name})
+		}
+	}
+
+	return matched
+}
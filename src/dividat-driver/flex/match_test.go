@@ -0,0 +1,111 @@
+package flex
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.bug.st/serial/enumerator"
+)
+
+func TestParsePortMatcher(t *testing.T) {
+	tests := []struct {
+		spec string
+		err  string
+	}{
+		{spec: "vid=16C0"},
+		{spec: "vid=16c0, pid=0483, serial=^FLX, product=Flex"},
+		{spec: "name=/dev/ttyACM0"},
+		{spec: "vid", err: "expected key=value"},
+		{spec: "vid=", err: "expected key=value"},
+		{spec: "vendor=16C0", err: "unknown condition"},
+		{spec: "serial=(", err: "invalid pattern"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			matcher, err := ParsePortMatcher(test.spec)
+			if test.err == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("got error %v, expected it to contain %q", err, test.err)
+			} else if test.err == "" && matcher.String() != test.spec {
+				t.Errorf("described as %q, expected %q", matcher.String(), test.spec)
+			}
+		})
+	}
+}
+
+func TestMatchPorts(t *testing.T) {
+	teensy := &enumerator.PortDetails{Name: "/dev/ttyACM0", IsUSB: true, VID: "16c0", PID: "0483", SerialNumber: "FLX123", Product: "Flex"}
+	otherTeensy := &enumerator.PortDetails{Name: "/dev/ttyACM1", IsUSB: true, VID: "16C0", PID: "0478", SerialNumber: "4711", Product: "Teensy"}
+	arduino := &enumerator.PortDetails{Name: "/dev/ttyACM2", IsUSB: true, VID: "2341", PID: "0043"}
+	ports := []*enumerator.PortDetails{teensy, otherTeensy, arduino}
+
+	tests := []struct {
+		name    string
+		rules   []string
+		matched []string
+	}{
+		{
+			name:    "vendor ID, ignoring case",
+			rules:   []string{"vid=16C0"},
+			matched: []string{"/dev/ttyACM0", "/dev/ttyACM1"},
+		},
+		{
+			name:    "all conditions must hold",
+			rules:   []string{"vid=16C0,pid=0483"},
+			matched: []string{"/dev/ttyACM0"},
+		},
+		{
+			name:    "serial number pattern",
+			rules:   []string{"serial=^FLX"},
+			matched: []string{"/dev/ttyACM0"},
+		},
+		{
+			name:    "product pattern",
+			rules:   []string{"product=^Teensy$"},
+			matched: []string{"/dev/ttyACM1"},
+		},
+		{
+			name:    "any rule",
+			rules:   []string{"pid=0043", "serial=^FLX"},
+			matched: []string{"/dev/ttyACM0", "/dev/ttyACM2"},
+		},
+		{
+			name:    "listed port by name",
+			rules:   []string{"name=/dev/ttyACM2"},
+			matched: []string{"/dev/ttyACM2"},
+		},
+		{
+			name:    "unlisted port by name",
+			rules:   []string{"name=/dev/pts/3", "vid=2341"},
+			matched: []string{"/dev/ttyACM2", "/dev/pts/3"},
+		},
+		{
+			name:  "unlisted port with further conditions",
+			rules: []string{"name=/dev/pts/3,vid=16C0"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var matchers []PortMatcher
+			for _, rule := range test.rules {
+				matcher, err := ParsePortMatcher(rule)
+				if err != nil {
+					t.Fatal(err)
+				}
+				matchers = append(matchers, matcher)
+			}
+
+			var matched []string
+			for _, port := range matchPorts(matchers, ports) {
+				matched = append(matched, port.Name)
+			}
+			if !reflect.DeepEqual(matched, test.matched) {
+				t.Errorf("matched %v, expected %v", matched, test.matched)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package protocol
+
+/* Bit depths of Senso Flex samples.
+
+The device sends measurement sets of samples: a row byte, a column byte and an
+8 bit value. The bit depth is selected with a device command, `UL` for 8 bits,
+which the driver has sent since its first version.
+
+There is no protocol reference for other bit depths in this repository. Devices
+are believed to select 12 and 16 bits with `UM` and `UH`, but neither these
+commands nor the layout of the samples they result in have been checked against
+the SensingTex documentation or a device. Only 8 bits can be selected, and the
+other commands are recognized only to keep them from devices, as the parser
+would lose track of samples if they changed the layout.
+
+*/
+
+import (
+	"bytes"
+	"sort"
+)
+
+// DefaultBitDepth is used unless another bit depth is selected
+const DefaultBitDepth = 8
+
+// Device commands selecting a bit depth (see above)
+var bitDepthCommands = map[int][]byte{
+	8:  []byte{'U', 'L', '\n'},
+	12: []byte{'U', 'M', '\n'},
+	16: []byte{'U', 'H', '\n'},
+}
+
+// Length of samples of the bit depths that can be selected, in bytes
+var sampleLengths = map[int]int{
+	8: 3,
+}
+
+// BitDepthCommand returns the device command selecting the bit depth, false if the bit depth is not supported
+func BitDepthCommand(bitDepth int) ([]byte, bool) {
+	if _, ok := sampleLengths[bitDepth]; !ok {
+		return nil, false
+	}
+	return bitDepthCommands[bitDepth], true
+}
+
+// SupportedBitDepths returns the bit depths that can be selected, in increasing order
+func SupportedBitDepths() []int {
+	bitDepths := make([]int, 0, len(sampleLengths))
+	for bitDepth := range sampleLengths {
+		bitDepths = append(bitDepths, bitDepth)
+	}
+	sort.Ints(bitDepths)
+	return bitDepths
+}
+
+// SampleLength returns the number of bytes of a sample of the bit depth, false if the bit depth is not supported
+func SampleLength(bitDepth int) (int, bool) {
+	length, ok := sampleLengths[bitDepth]
+	return length, ok
+}
+
+// InterceptBitDepthCommands removes bit depth commands from data, returning the remaining commands and the bit depth
+// selected by the last bit depth command, which may not be supported, false if there is none.
+//
+// Commands are separated by newlines. Bit depth commands are recognized with surrounding whitespace, like a carriage
+// return, and without a final newline at the end of data.
+func InterceptBitDepthCommands(data []byte) ([]byte, int, bool) {
+	var rest []byte
+	var selected int
+	found := false
+
+	for len(data) > 0 {
+		line := data
+		if end := bytes.IndexByte(data, '\n'); end >= 0 {
+			line = data[:end+1]
+		}
+		data = data[len(line):]
+
+		if bitDepth, ok := bitDepthOfCommand(line); ok {
+			selected = bitDepth
+			found = true
+		} else {
+			rest = append(rest, line...)
+		}
+	}
+
+	return rest, selected, found
+}
+
+// bitDepthOfCommand returns the bit depth selected by a single command, false if it is not a bit depth command
+func bitDepthOfCommand(line []byte) (int, bool) {
+	trimmed := bytes.TrimSpace(line)
+	for bitDepth, command := range bitDepthCommands {
+		if bytes.Equal(trimmed, bytes.TrimSpace(command)) {
+			return bitDepth, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,62 @@
+package protocol
+
+import (
+	"testing"
+)
+
+func TestInterceptBitDepthCommands(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		rest     string
+		bitDepth int
+		ok       bool
+	}{
+		{name: "command", data: "UM\n", bitDepth: 12, ok: true},
+		{name: "carriage return", data: "UH\r\n", bitDepth: 16, ok: true},
+		{name: "whitespace", data: " UL \n", bitDepth: 8, ok: true},
+		{name: "no newline", data: "UM", bitDepth: 12, ok: true},
+		{name: "other commands", data: "S\nUH\nS\n", rest: "S\nS\n", bitDepth: 16, ok: true},
+		{name: "last command", data: "UM\nUH\n", bitDepth: 16, ok: true},
+		{name: "no bit depth command", data: "S\nUMX\n", rest: "S\nUMX\n"},
+		{name: "empty", data: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rest, bitDepth, ok := InterceptBitDepthCommands([]byte(test.data))
+			if string(rest) != test.rest {
+				t.Errorf("kept %q, expected %q", rest, test.rest)
+			}
+			if bitDepth != test.bitDepth || ok != test.ok {
+				t.Errorf("got bit depth %d (%v), expected %d (%v)", bitDepth, ok, test.bitDepth, test.ok)
+			}
+		})
+	}
+}
+
+func TestSupportedBitDepths(t *testing.T) {
+	tests := []struct {
+		bitDepth     int
+		command      string
+		sampleLength int
+		ok           bool
+	}{
+		{bitDepth: 8, command: "UL\n", sampleLength: 3, ok: true},
+		// Not confirmed with the device protocol
+		{bitDepth: 12},
+		{bitDepth: 16},
+		{bitDepth: 10},
+	}
+
+	for _, test := range tests {
+		command, ok := BitDepthCommand(test.bitDepth)
+		if string(command) != test.command || ok != test.ok {
+			t.Errorf("bit depth %d has command %q (%v), expected %q (%v)", test.bitDepth, command, ok, test.command, test.ok)
+		}
+		sampleLength, ok := SampleLength(test.bitDepth)
+		if sampleLength != test.sampleLength || ok != test.ok {
+			t.Errorf("bit depth %d has sample length %d (%v), expected %d (%v)", test.bitDepth, sampleLength, ok, test.sampleLength, test.ok)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package flex
+
+/* Replaying a recording in place of serial devices.
+
+With replay URLs as sources (see the recording package), the received packets
+of the recordings are sent to clients instead of data from serial devices, like
+`replay://rec/flex/zero.dat?speed=0.5`. Every source is replayed as a device of
+its own, identified by the URL. Commands from clients are discarded.
+
+Sets are decoded with the bit depth stated in the metadata of the recording, and
+the bit depth commands sent to the device in the recording are followed.
+
+*/
+
+import (
+	"context"
+
+	"github.com/dividat/driver/src/dividat-driver/flex/protocol"
+	"github.com/dividat/driver/src/dividat-driver/recording"
+)
+
+// replayLoop replays the recording of source, until the recording ends or ctx is cancelled
+func (handle *Handle) replayLoop(ctx context.Context, source string, tx chan interface{}, onReceive func([]byte), onBitDepth func(int), onStatus func(Status)) {
+	log := handle.log.WithField("source", source)
+
+	options, err := recording.ParseReplayURL(source)
+	if err != nil {
+		log.WithError(err).Warning("Could not replay recording.")
+		onStatus(Status{State: StateDisconnected, Reason: err.Error()})
+		return
+	}
+
+	// Recordings made by the driver state the serial of the recorded device
+	metadata, err := recording.ReadMetadata(options.Path)
+	if err != nil {
+		log.WithError(err).Warning("Could not replay recording.")
+		onStatus(Status{State: StateDisconnected, Reason: err.Error()})
+		return
+	}
+	port := Port{Name: source}
+	if metadata != nil {
+		port.SerialNumber = metadata.Serial
+	}
+
+	// Discard commands, as there is no device to send them to
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-tx:
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+
+	log.WithField("speed", options.Speed).WithField("loop", options.Loop).Info("Replaying recording.")
+	onStatus(Status{State: StateConnected, Port: &port})
+	// Every pass starts with the bit depth of the recording
+	onStart := func(metadata *recording.Metadata) {
+		bitDepth := protocol.DefaultBitDepth
+		if metadata != nil && metadata.BitDepth != 0 {
+			bitDepth = metadata.BitDepth
+		}
+		onBitDepth(bitDepth)
+	}
+	onSent := func(data []byte) {
+		if _, bitDepth, ok := protocol.InterceptBitDepthCommands(data); ok {
+			onBitDepth(bitDepth)
+		}
+	}
+	err = recording.ReplayWithSent(ctx, options.Path, options.Speed, options.Loop, onStart, onReceive, onSent)
+	if ctx.Err() != nil {
+		log.Info("Replay stopped.")
+	} else if err != nil {
+		log.WithError(err).Warning("Could not replay recording.")
+		onStatus(Status{State: StateDisconnected, Port: &port, Reason: err.Error()})
+	} else {
+		log.Info("End of recording.")
+		onStatus(Status{State: StateDisconnected, Port: &port, Reason: "End of recording."})
+	}
+}
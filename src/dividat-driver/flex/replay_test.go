@@ -0,0 +1,85 @@
+package flex
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/dividat/driver/src/dividat-driver/recording"
+)
+
+// writeRecording writes a Senso Flex recording starting with the bit depth to path and returns the path
+func writeRecording(t *testing.T, path string, bitDepth int, entries []recording.Entry) string {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	writer, err := recording.NewWriter(file, recording.Metadata{Device: "flex", Source: recording.SourceDriver, BitDepth: bitDepth, StartTime: time.Now()}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if err := writer.WriteAfter(entry.Direction, entry.Data, entry.Time); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReplayBitDepth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dividat-driver-flex-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Sets of 12 bits are not decoded, instead of being decoded as garbage 8 bit sets of the same length
+	path := writeRecording(t, filepath.Join(dir, "bitdepth.dat"), 12, []recording.Entry{
+		{Time: 0, Direction: recording.DirectionRx, Data: []byte{0, 0, 0x0F, 0xA0, 0, 1, 0, 1, 1, 0, 0, 2}},
+		{Time: 10 * time.Millisecond, Direction: recording.DirectionTx, Data: []byte("UL\n")},
+		{Time: 20 * time.Millisecond, Direction: recording.DirectionRx, Data: []byte{0, 0, 7, 1, 2, 200}},
+		{Time: 30 * time.Millisecond, Direction: recording.DirectionTx, Data: []byte("UM\n")},
+		{Time: 40 * time.Millisecond, Direction: recording.DirectionRx, Data: []byte{0, 0, 0x0F, 0xA0, 0, 1, 0, 1, 1, 0, 0, 2}},
+	})
+
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := "replay://" + path
+	handle := New(ctx, logrus.NewEntry(log), Config{Sources: []string{source}})
+	frames := handle.broker.Sub("flex-frames")
+	defer handle.broker.Unsub(frames)
+	handle.Connect()
+
+	// Every pass over the recording starts with the bit depth stated in the metadata
+	var received []*Frame
+	timeout := time.After(300 * time.Millisecond)
+	for len(received) < 2 {
+		select {
+		case i := <-frames:
+			received = append(received, i.(*Frame))
+		case <-timeout:
+			t.Fatalf("received %d frames, expected 2", len(received))
+		}
+	}
+	for _, frame := range received {
+		if frame.Device != source || frame.BitDepth != 8 || frame.Rows != 2 || frame.Columns != 3 {
+			t.Fatalf("got frame %+v, expected a 2x3 frame of bit depth 8 of %s", *frame, source)
+		}
+		if frame.Values[0] != 7 || frame.Values[5] != 200 {
+			t.Errorf("frame has values %v, expected 7 and 200", frame.Values)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package flex
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go.bug.st/serial/enumerator"
+)
+
+// States of the connection to a device
+const (
+	// No clients, not looking for devices
+	StateIdle = "Idle"
+	// Looking for a device on the serial ports
+	StateScanning = "Scanning"
+	// Receiving measurement sets from a device, from at least one device for the connection as a whole
+	StateConnected = "Connected"
+	// Connection to a device failed or was lost, scanning resumes shortly
+	StateDisconnected = "Disconnected"
+)
+
+// Status of the connection to a device, or of the connection as a whole if Device is empty
+type Status struct {
+	State string `json:"state"`
+	// ID of the device (see `device.go`)
+	Device string `json:"device,omitempty"`
+	// Serial port of the device, set for the connection as a whole when exactly one device is connected
+	Port *Port `json:"port,omitempty"`
+	// Why the connection failed or was lost, kept while scanning
+	Reason string `json:"reason,omitempty"`
+	// Whether the device is the primary device (see `device.go`), only given in lists of devices
+	Primary bool `json:"primary,omitempty"`
+}
+
+// Port describes a serial port
+type Port struct {
+	Name         string `json:"name"`
+	VID          string `json:"vid,omitempty"`
+	PID          string `json:"pid,omitempty"`
+	SerialNumber string `json:"serialNumber,omitempty"`
+}
+
+func (status Status) equal(other Status) bool {
+	return status.State == other.State &&
+		status.Device == other.Device &&
+		status.Reason == other.Reason &&
+		(status.Port == other.Port || (status.Port != nil && other.Port != nil && *status.Port == *other.Port))
+}
+
+func portOfDetails(details *enumerator.PortDetails) *Port {
+	return &Port{
+		Name:         details.Name,
+		VID:          details.VID,
+		PID:          details.PID,
+		SerialNumber: details.SerialNumber,
+	}
+}
+
+// setStatus records the status of the connection as a whole and notifies subscribers of changes
+func (handle *Handle) setStatus(status Status) {
+	handle.statusMutex.Lock()
+	// The reason of a disconnect is kept while scanning
+	if status.State == StateScanning && status.Reason == "" {
+		status.Reason = handle.status.Reason
+	}
+	// Unchanged statuses are not repeated, like scanning repeatedly
+	if status.equal(handle.status) {
+		handle.statusMutex.Unlock()
+		return
+	}
+	handle.status = status
+	handle.statusMutex.Unlock()
+
+	handle.broker.TryPub(&status, "flex-status")
+}
+
+// GetStatus returns the status of the connection as a whole
+func (handle *Handle) GetStatus() Status {
+	handle.statusMutex.Lock()
+	defer handle.statusMutex.Unlock()
+	return handle.status
+}
+
+// ServeStatus responds with the status of the connection
+func (handle *Handle) ServeStatus(w http.ResponseWriter, r *http.Request) {
+	status := handle.GetStatus()
+	statusJson, _ := json.Marshal(&status)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(statusJson)
+}
@@ -2,18 +2,131 @@ package flex
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
+
+	"github.com/dividat/driver/src/dividat-driver/flex/protocol"
+	"github.com/dividat/driver/src/dividat-driver/recording"
 )
 
 // WEBSOCKET PROTOCOL
 
+// Command sent by clients as text message
+type Command struct {
+	*SetFormat
+
+	*SetBitDepth
+
+	*Subscribe
+
+	*GetDevices
+}
+
+func prettyPrintCommand(command Command) string {
+	if command.SetFormat != nil {
+		return "SetFormat"
+	} else if command.SetBitDepth != nil {
+		return "SetBitDepth"
+	} else if command.Subscribe != nil {
+		return "Subscribe"
+	} else if command.GetDevices != nil {
+		return "GetDevices"
+	}
+	return "Unknown"
+}
+
+// SetFormat command, selects how measurement sets are sent up the WebSocket
+type SetFormat struct {
+	Format string `json:"format"`
+}
+
+// SetBitDepth command, selects the bit depth of samples (see `bitdepth.go`)
+type SetBitDepth struct {
+	BitDepth int `json:"bitDepth"`
+}
+
+// Subscribe command, selects the device whose data is sent up the WebSocket and which receives binary commands.
+// If empty, frames of all devices are sent, raw sets are sent from and commands to the primary device (see `device.go`).
+type Subscribe struct {
+	Device string `json:"device"`
+}
+
+// GetDevices command, requests the statuses of all devices
+type GetDevices struct{}
+
+// Formats in which measurement sets can be sent
+const (
+	// Raw sets as assembled from the device, in binary messages (default)
+	FormatBinary = "binary"
+	// Decoded frames, in JSON messages
+	FormatJSON = "json"
+	// Decoded frames in the binary layout of frames (see `frame.go`), in binary messages
+	FormatMatrix = "matrix"
+)
+
+// UnmarshalJSON implements encoding/json Unmarshaler interface
+func (command *Command) UnmarshalJSON(data []byte) error {
+
+	// Helper struct to get type
+	temp := struct {
+		Type string `json:"type"`
+	}{}
+	if err := json.Unmarshal(data, &temp); err != nil {
+		return err
+	}
+
+	if temp.Type == "SetFormat" {
+		err := json.Unmarshal(data, &command.SetFormat)
+		if err != nil {
+			return err
+		}
+
+	} else if temp.Type == "SetBitDepth" {
+		err := json.Unmarshal(data, &command.SetBitDepth)
+		if err != nil {
+			return err
+		}
+
+	} else if temp.Type == "Subscribe" {
+		err := json.Unmarshal(data, &command.Subscribe)
+		if err != nil {
+			return err
+		}
+
+	} else if temp.Type == "GetDevices" {
+		command.GetDevices = &GetDevices{}
+
+	} else {
+		return errors.New("can not decode unknown command")
+	}
+
+	return nil
+}
+
 // Implement net/http Handler interface
 func (handle *Handle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/flex/record" || strings.HasPrefix(r.URL.Path, "/flex/record/") {
+		handle.recorder.Serve(w, r, strings.TrimPrefix(r.URL.Path, "/flex/record"))
+	} else if r.URL.Path == "/flex/status" {
+		handle.ServeStatus(w, r)
+	} else if r.URL.Path == "/flex/devices" {
+		handle.ServeDevices(w, r)
+	} else if r.URL.Path == "/flex" || r.URL.Path == "/flex/" {
+		handle.StreamData(w, r)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+// StreamData upgrades to a WebSocket connection forwarding data from and to the device
+func (handle *Handle) StreamData(w http.ResponseWriter, r *http.Request) {
 
 	// Set up logger
 	var log = handle.log.WithFields(logrus.Fields{
@@ -52,11 +165,105 @@ func (handle *Handle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return nil
 	}
 
-	// Create channels with data received from SensingTex controller
-	rx := handle.broker.Sub("flex-rx")
+	// Send JSON messages up the WebSocket
+	sendJSON := func(message interface{}) error {
+		writeMutex.Lock()
+		conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+		err := conn.WriteJSON(message)
+		writeMutex.Unlock()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.WithError(err).Error("WebSocket error")
+			}
+			return err
+		}
+		return nil
+	}
+
+	// Create channels with data received from SensingTex controllers, raw data of the primary device is sent by default. Status changes are always sent.
+	format := FormatBinary
+	device := ""
+	subscriptionMutex := sync.Mutex{}
+	rx := handle.broker.Sub(dataTopic(format, device), "flex-status")
+
+	// Send decoded frames in the selected format
+	sendFrame := func(frame *Frame) error {
+		subscriptionMutex.Lock()
+		currentFormat := format
+		subscriptionMutex.Unlock()
+
+		if currentFormat == FormatMatrix {
+			return sendBinary(frame.Encode())
+		}
+		return sendJSON(frame)
+	}
+
+	sendStatus := func(status *Status) error {
+		return sendJSON(&struct {
+			Type string `json:"type"`
+			*Status
+		}{
+			Type:   "Status",
+			Status: status,
+		})
+	}
+
+	sendDevices := func() error {
+		return sendJSON(&struct {
+			Type    string   `json:"type"`
+			Devices []Status `json:"devices"`
+		}{
+			Type:    "Devices",
+			Devices: handle.Devices(),
+		})
+	}
+
+	// Switch between raw data and decoded frames, or between devices, by changing the subscribed topic
+	subscribe := func(newFormat string, newDevice string) {
+		subscriptionMutex.Lock()
+		defer subscriptionMutex.Unlock()
+
+		oldTopic, newTopic := dataTopic(format, device), dataTopic(newFormat, newDevice)
+		if newTopic != oldTopic {
+			handle.broker.AddSub(rx, newTopic)
+			handle.broker.Unsub(rx, oldTopic)
+		}
+		format = newFormat
+		device = newDevice
+	}
+
+	setFormat := func(newFormat string) {
+		if newFormat != FormatBinary && newFormat != FormatJSON && newFormat != FormatMatrix {
+			log.WithField("format", newFormat).Warning("Unknown format requested.")
+			return
+		}
+
+		subscriptionMutex.Lock()
+		currentDevice := device
+		subscriptionMutex.Unlock()
+		subscribe(newFormat, currentDevice)
+	}
+
+	setDevice := func(newDevice string) {
+		subscriptionMutex.Lock()
+		currentFormat := format
+		subscriptionMutex.Unlock()
+		subscribe(currentFormat, newDevice)
+	}
+
+	// Binary commands are sent to the selected device, or the primary device if none is selected
+	txTopic := func() string {
+		subscriptionMutex.Lock()
+		currentDevice := device
+		subscriptionMutex.Unlock()
+		if currentDevice == "" {
+			currentDevice = handle.PrimaryDevice()
+		}
+		return deviceTopic("flex-tx", currentDevice)
+	}
 
 	// send data from device
-	go rx_data_loop(ctx, rx, sendBinary)
+	go rx_data_loop(ctx, rx, sendBinary, sendFrame, sendStatus)
 
 	// Helper function to close the connection
 	close := func() {
@@ -73,8 +280,10 @@ func (handle *Handle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		log.Info("Websocket connection closed")
 	}
 
-	// Start connecting to devices
+	// Start connecting to devices, and tell the client about the current status
 	handle.Connect()
+	status := handle.GetStatus()
+	sendStatus(&status)
 
 	// Main loop for the WebSocket connection
 	go func() {
@@ -89,7 +298,43 @@ func (handle *Handle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			if messageType == websocket.BinaryMessage {
-				handle.broker.TryPub(msg, "flex-tx")
+				// Changes of the bit depth must go through the parser, they are recorded once applied
+				commands, bitDepth, ok := protocol.InterceptBitDepthCommands(msg)
+				if ok {
+					log.WithField("bitDepth", bitDepth).Debug("Intercepted bit depth command.")
+					if err := handle.SetBitDepth(bitDepth); err != nil {
+						log.WithError(err).Warning("Can not set bit depth.")
+					}
+				}
+				if len(commands) == 0 {
+					continue
+				}
+
+				handle.recorder.Record(recording.DirectionTx, commands)
+				handle.broker.TryPub(commands, txTopic())
+
+			} else if messageType == websocket.TextMessage {
+
+				var command Command
+				decodeErr := json.Unmarshal(msg, &command)
+				if decodeErr != nil {
+					log.WithField("rawCommand", msg).WithError(decodeErr).Warning("Can not decode command.")
+					continue
+				}
+				log.WithField("command", prettyPrintCommand(command)).Debug("Received command.")
+
+				if command.SetFormat != nil {
+					setFormat(command.SetFormat.Format)
+				} else if command.SetBitDepth != nil {
+					err := handle.SetBitDepth(command.SetBitDepth.BitDepth)
+					if err != nil {
+						log.WithError(err).Warning("Can not set bit depth.")
+					}
+				} else if command.Subscribe != nil {
+					setDevice(command.Subscribe.Device)
+				} else if command.GetDevices != nil {
+					sendDevices()
+				}
 			}
 		}
 	}()
@@ -98,8 +343,16 @@ func (handle *Handle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // HELPERS
 
+// dataTopic returns the topic of measurement sets in the format, of a single device or the default topic if device is empty
+func dataTopic(format string, device string) string {
+	if format == FormatBinary {
+		return deviceTopic("flex-rx", device)
+	}
+	return deviceTopic("flex-frames", device)
+}
+
 // rx_data_loop reads data from SensingTex and forwards it up the WebSocket
-func rx_data_loop(ctx context.Context, rx chan interface{}, send func([]byte) error) {
+func rx_data_loop(ctx context.Context, rx chan interface{}, send func([]byte) error, sendFrame func(*Frame) error, sendStatus func(*Status) error) {
 	var err error
 	for {
 		select {
@@ -107,9 +360,13 @@ func rx_data_loop(ctx context.Context, rx chan interface{}, send func([]byte) er
 			return
 
 		case i := <-rx:
-			data, ok := i.([]byte)
-			if ok {
-				err = send(data)
+			switch v := i.(type) {
+			case []byte:
+				err = send(v)
+			case *Frame:
+				err = sendFrame(v)
+			case *Status:
+				err = sendStatus(v)
 			}
 		}
 
@@ -5,14 +5,19 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"strings"
 
 	"github.com/dividat/driver/src/dividat-driver/firmware"
+	"github.com/dividat/driver/src/dividat-driver/flex"
 	"github.com/dividat/driver/src/dividat-driver/logging"
+	"github.com/dividat/driver/src/dividat-driver/recording"
+	"github.com/dividat/driver/src/dividat-driver/senso"
 	"github.com/dividat/driver/src/dividat-driver/server"
+	"github.com/dividat/driver/src/dividat-driver/simulator"
 	"github.com/kardianos/service"
 	"github.com/sirupsen/logrus"
 )
@@ -25,6 +30,14 @@ func main() {
 	// Serve command or start in daemon mode by default
 	if len(os.Args) > 1 && os.Args[1] == "update-firmware" {
 		firmware.Command(os.Args[2:])
+	} else if len(os.Args) > 1 && os.Args[1] == "list-sensos" {
+		firmware.ListCommand(os.Args[2:])
+	} else if len(os.Args) > 1 && os.Args[1] == "simulate-senso" {
+		simulator.Command(os.Args[2:])
+	} else if len(os.Args) > 1 && os.Args[1] == "convert-recording" {
+		recording.ConvertCommand(os.Args[2:])
+	} else if len(os.Args) > 1 && os.Args[1] == "inspect-recording" {
+		recording.InspectCommand(os.Args[2:])
 	} else {
 		runDaemon()
 	}
@@ -44,13 +57,68 @@ func (p *program) Start(s service.Service) error {
 	// Command-line flags
 	var permissibleOrigins stringList
 	flag.Var(&permissibleOrigins, "permissible-origin", "Permissible origin to make requests to the driver's HTTP endpoints, may be repeated. Default is a list of common Dividat origins.")
+	sensoAutoConnect := flag.Bool("senso-auto-connect", false, "Connect to the last connected Senso on startup, or to the only Senso discovered on the network.")
+	sensoStatePath := flag.String("senso-state-file", senso.DefaultStatePath(), "File in which the last connected Senso is remembered for auto-connecting.")
+	var flexSources stringList
+	flag.Var(&flexSources, "flex-source", "Replay URL of a recording to replay in place of Senso Flex devices, like replay://rec/flex/zero.dat?speed=0.5, may be repeated to replay several devices.")
+	var flexPorts stringList
+	flag.Var(&flexPorts, "flex-port", "Rule selecting serial ports of Senso Flex devices, like vid=16C0,pid=0483 (conditions: name, vid, pid, serial, product), may be repeated. Default is any Teensy (vid=16C0).")
+	flexProbe := flag.Bool("flex-probe", false, "Require Senso Flex devices to answer with a measurement set before connecting to them.")
+	recordingDir := flag.String("recording-dir", recording.DefaultDir(), "Directory in which recordings of device streams are stored.")
+	recordingCompress := flag.Bool("recording-compress", false, "Compress recordings of device streams with gzip.")
+	firmwareKeyPath := flag.String("firmware-key", "", "PEM encoded public key to verify signatures of firmware images with. Default is the embedded Dividat key.")
 	flag.Parse()
 	if len(permissibleOrigins) == 0 {
 		permissibleOrigins = defaultOrigins
 	}
 
 	// Start server
-	p.close = server.Start(logger, permissibleOrigins)
+	sensoConfig := senso.Config{
+		AutoConnect: *sensoAutoConnect,
+		StatePath:   *sensoStatePath,
+	}
+
+	flexConfig := flex.Config{
+		Sources: flexSources,
+		Probe:   *flexProbe,
+	}
+	for _, rule := range flexPorts {
+		matcher, err := flex.ParsePortMatcher(rule)
+		if err != nil {
+			return err
+		}
+		flexConfig.Ports = append(flexConfig.Ports, matcher)
+	}
+	replayed := make(map[string]bool)
+	for _, source := range flexConfig.Sources {
+		if _, err := recording.ParseReplayURL(source); err != nil {
+			return err
+		}
+		// Sources identify the replayed devices
+		if replayed[source] {
+			return fmt.Errorf("flex source %q given twice", source)
+		}
+		replayed[source] = true
+	}
+
+	recordingConfig := recording.Config{
+		Dir:      *recordingDir,
+		Compress: *recordingCompress,
+	}
+
+	firmwareConfig := firmware.Config{}
+	if *firmwareKeyPath != "" {
+		pemData, err := ioutil.ReadFile(*firmwareKeyPath)
+		if err != nil {
+			return fmt.Errorf("could not read firmware key: %v", err)
+		}
+		firmwareConfig.PublicKey, err = firmware.ParsePublicKey(pemData)
+		if err != nil {
+			return fmt.Errorf("invalid firmware key: %v", err)
+		}
+	}
+
+	p.close = server.Start(logger, permissibleOrigins, sensoConfig, flexConfig, recordingConfig, firmwareConfig)
 	return nil
 }
 
@@ -1,21 +1,26 @@
 package main
 
 import (
-	"encoding/base64"
-	"fmt"
+	"flag"
 	"log"
 	"net/url"
 	"os"
 	"os/signal"
+	"path"
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"github.com/dividat/driver/src/dividat-driver/recording"
 )
 
 func main() {
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
 
+	compress := flag.Bool("gzip", false, "Compress the recording with gzip")
+	flag.Parse()
+
 	u := parseUrl()
 
 	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
@@ -24,7 +29,16 @@ func main() {
 	}
 	defer c.Close()
 
-	prev := time.Now()
+	metadata := recording.Metadata{
+		Device:    path.Base(u.Path),
+		Source:    u.String(),
+		StartTime: time.Now(),
+	}
+	writer, err := recording.NewWriter(os.Stdout, metadata, *compress)
+	if err != nil {
+		log.Fatalf("Could not write recording: %s", err)
+	}
+	defer writer.Close()
 
 	done := make(chan struct{})
 	go func() {
@@ -34,11 +48,7 @@ func main() {
 			if err != nil {
 				break
 			}
-			encoded := base64.StdEncoding.EncodeToString(message)
-			now := time.Now()
-			d := now.Sub(prev)
-			prev = now
-			fmt.Println(fmt.Sprintf("%d, ", d.Nanoseconds()/1000000) + encoded)
+			err = writer.Write(recording.DirectionRx, message, time.Now())
 			if err != nil {
 				panic(err)
 			}
@@ -60,10 +70,10 @@ func main() {
 }
 
 func parseUrl() url.URL {
-	if (len(os.Args) < 2) {
+	if flag.NArg() < 1 {
 		log.Fatal("Expected the WebSocket URL to record from as a parameter")
 	}
-	u, err := url.Parse(os.Args[1])
+	u, err := url.Parse(flag.Arg(0))
 	if err != nil {
 		log.Fatalf("Malformed WebSocket URL: %s", err)
 	}
@@ -0,0 +1,137 @@
+package recording
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ConvertCommand is the command-line interface to Convert
+func ConvertCommand(flags []string) {
+	convertFlags := flag.NewFlagSet("convert-recording", flag.ExitOnError)
+	device := convertFlags.String("device", "senso", "Kind of device that was recorded (senso or flex)")
+	serial := convertFlags.String("serial", "", "Serial of the recorded device")
+	start := convertFlags.String("start", "", "Start time of the recording (RFC 3339), estimated from the modification time of the input if not given")
+	output := convertFlags.String("o", "", "Output file, written to standard output if not given")
+	compress := convertFlags.Bool("gzip", false, "Compress the output with gzip, the default if the output file ends with .gz")
+	convertFlags.Usage = func() {
+		fmt.Fprintf(convertFlags.Output(), "Usage: %s convert-recording [flags] <recording>\n", os.Args[0])
+		convertFlags.PrintDefaults()
+	}
+	convertFlags.Parse(flags)
+
+	if convertFlags.NArg() != 1 {
+		convertFlags.Usage()
+		os.Exit(1)
+	}
+	input := convertFlags.Arg(0)
+
+	metadata := Metadata{
+		Device: *device,
+		Serial: *serial,
+		Source: SourceConverted,
+	}
+	var err error
+	if *start != "" {
+		metadata.StartTime, err = time.Parse(time.RFC3339, *start)
+	} else {
+		metadata.StartTime, err = estimateStartTime(input)
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	in, err := os.Open(input)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	defer in.Close()
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		defer file.Close()
+		out = file
+		*compress = *compress || strings.HasSuffix(*output, ".gz")
+	}
+
+	err = Convert(in, out, metadata, *compress)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not convert %s: %v\n", input, err)
+		os.Exit(1)
+	}
+}
+
+// Convert the recording read from r to the current version of the format, written to w.
+//
+// Recordings in the current version keep their metadata, so that they can be compressed or decompressed.
+func Convert(r io.Reader, w io.Writer, metadata Metadata, compress bool) error {
+	reader, err := NewReader(r)
+	if err != nil {
+		return err
+	}
+	if reader.Metadata != nil {
+		metadata = *reader.Metadata
+	}
+
+	writer, err := NewWriter(w, metadata, compress)
+	if err != nil {
+		return err
+	}
+
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		err = writer.WriteAfter(entry.Direction, entry.Data, entry.Time)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writer.Close()
+}
+
+// estimateStartTime assumes that the recording at path was last modified when it ended
+func estimateStartTime(path string) (time.Time, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	reader, err := NewReader(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var duration time.Duration
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return time.Time{}, err
+		}
+		duration = entry.Time
+	}
+
+	return info.ModTime().Add(-duration), nil
+}
@@ -0,0 +1,453 @@
+package recording
+
+/* Inspecting recordings.
+
+The `inspect-recording` subcommand decodes the received packets of a recording
+and reports its timing, malformed frames and the range of the recorded values,
+to check recordings before they are used as fixtures.
+
+Senso recordings are decoded with the Senso protocol, reporting values of
+measurements per plate (sum of its sensors) and per sensor. Senso Flex packets
+consist of samples of a row, a column and a value, values are reported over all
+samples. The length of samples follows the bit depth stated in the metadata and
+the bit depth commands sent to the device (see `flex/protocol/bitdepth.go`).
+
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	flexprotocol "github.com/dividat/driver/src/dividat-driver/flex/protocol"
+	"github.com/dividat/driver/src/dividat-driver/senso/protocol"
+)
+
+// Upper bounds of the buckets of the interval histogram, the last bucket is unbounded
+var intervalBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	15 * time.Millisecond,
+	20 * time.Millisecond,
+	25 * time.Millisecond,
+	30 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+}
+
+// Maximum number of error messages kept in a report
+const maxReportedErrors = 10
+
+// Report of an inspected recording. Durations are given in milliseconds.
+type Report struct {
+	File     string    `json:"file"`
+	Version  int       `json:"version"`
+	Metadata *Metadata `json:"metadata"`
+	// Kind of device the packets were decoded for
+	Device string `json:"device"`
+
+	Duration float64 `json:"duration"`
+	Received int     `json:"received"`
+	Sent     int     `json:"sent"`
+	// Received packets per second
+	PacketRate float64 `json:"packetRate"`
+	// Intervals between received packets
+	Interval  Stats    `json:"interval"`
+	Histogram []Bucket `json:"histogram"`
+	Gaps      []Gap    `json:"gaps"`
+
+	// Decoded frames, measurements for Senso and sample sets for Senso Flex
+	Frames    int      `json:"frames"`
+	Malformed int      `json:"malformed"`
+	Errors    []string `json:"errors"`
+
+	// Senso only
+	Plates  []Stats   `json:"plates,omitempty"`
+	Sensors [][]Stats `json:"sensors,omitempty"`
+	// Senso Flex only
+	Samples *Stats `json:"samples,omitempty"`
+}
+
+// Stats summarize a series of values
+type Stats struct {
+	Count int     `json:"count"`
+	Min   float64 `json:"min"`
+	Mean  float64 `json:"mean"`
+	Max   float64 `json:"max"`
+	// Standard deviation
+	Deviation float64 `json:"deviation"`
+
+	sum        float64
+	sumSquares float64
+}
+
+// Bucket of the interval histogram, counting intervals up to Below (exclusive), unbounded if Below is zero
+type Bucket struct {
+	Below float64 `json:"below,omitempty"`
+	Count int     `json:"count"`
+}
+
+// Gap between two received packets
+type Gap struct {
+	// Time of the packet preceding the gap
+	At     float64 `json:"at"`
+	Length float64 `json:"length"`
+}
+
+// InspectCommand is the command-line interface to Inspect
+func InspectCommand(flags []string) {
+	inspectFlags := flag.NewFlagSet("inspect-recording", flag.ExitOnError)
+	device := inspectFlags.String("device", "", "Kind of device that was recorded (senso or flex), taken from the metadata if not given, senso for version 1 recordings")
+	gap := inspectFlags.Duration("gap", 100*time.Millisecond, "Intervals between received packets longer than this are reported as gaps")
+	format := inspectFlags.String("format", "text", "Output format (text or json)")
+	sensors := inspectFlags.Bool("sensors", false, "Report values per sensor in addition to per plate (text output only, always included in JSON)")
+	inspectFlags.Usage = func() {
+		fmt.Fprintf(inspectFlags.Output(), "Usage: %s inspect-recording [flags] <recording>\n", os.Args[0])
+		inspectFlags.PrintDefaults()
+	}
+	inspectFlags.Parse(flags)
+
+	if inspectFlags.NArg() != 1 {
+		inspectFlags.Usage()
+		os.Exit(1)
+	}
+	if *format != "text" && *format != "json" {
+		fmt.Printf("Unknown format %q, expected text or json.\n", *format)
+		os.Exit(1)
+	}
+	input := inspectFlags.Arg(0)
+
+	file, err := os.Open(input)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	report, err := Inspect(file, *device, *gap)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not inspect %s: %v\n", input, err)
+		os.Exit(1)
+	}
+	report.File = input
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	} else {
+		printReport(os.Stdout, report, *sensors)
+	}
+}
+
+// Inspect the recording read from r.
+//
+// Device overrides the kind of device stated in the metadata. Intervals between
+// received packets longer than gap are reported as gaps.
+func Inspect(r io.Reader, device string, gap time.Duration) (*Report, error) {
+	reader, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	report := Report{
+		Version:   reader.Version,
+		Metadata:  reader.Metadata,
+		Device:    device,
+		Gaps:      []Gap{},
+		Errors:    []string{},
+		Histogram: make([]Bucket, len(intervalBuckets)+1),
+	}
+	if report.Device == "" && reader.Metadata != nil {
+		report.Device = reader.Metadata.Device
+	}
+	if report.Device == "" {
+		report.Device = "senso"
+	}
+	for ix, below := range intervalBuckets {
+		report.Histogram[ix].Below = milliseconds(below)
+	}
+
+	var inspectPacket, inspectSent func([]byte)
+	var finish func()
+	switch report.Device {
+	case "senso":
+		inspectPacket, inspectSent, finish = report.sensoInspector()
+	case "flex":
+		inspectPacket, inspectSent, finish = report.flexInspector(reader.Metadata)
+	default:
+		return nil, fmt.Errorf("unknown device %q", report.Device)
+	}
+
+	var previous *time.Duration
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		report.Duration = milliseconds(entry.Time)
+		if entry.Direction == DirectionTx {
+			report.Sent++
+			inspectSent(entry.Data)
+			continue
+		}
+		report.Received++
+
+		if previous != nil {
+			interval := entry.Time - *previous
+			report.Interval.add(milliseconds(interval))
+			report.countInterval(interval)
+			if interval > gap {
+				report.Gaps = append(report.Gaps, Gap{At: milliseconds(*previous), Length: milliseconds(interval)})
+			}
+		}
+		entryTime := entry.Time
+		previous = &entryTime
+
+		inspectPacket(entry.Data)
+	}
+	finish()
+
+	if report.Duration > 0 {
+		report.PacketRate = float64(report.Received) / (report.Duration / 1000)
+	}
+	report.Interval.finish()
+
+	return &report, nil
+}
+
+// countInterval adds an interval to the histogram
+func (report *Report) countInterval(interval time.Duration) {
+	for ix, below := range intervalBuckets {
+		if interval < below {
+			report.Histogram[ix].Count++
+			return
+		}
+	}
+	report.Histogram[len(intervalBuckets)].Count++
+}
+
+// addError counts a malformed frame, keeping the first error messages
+func (report *Report) addError(err error) {
+	report.Malformed++
+	if len(report.Errors) < maxReportedErrors {
+		report.Errors = append(report.Errors, err.Error())
+	}
+}
+
+// sensoInspector decodes Senso packets, which may be split across or combined in received packets
+func (report *Report) sensoInspector() (func([]byte), func([]byte), func()) {
+	report.Plates = make([]Stats, protocol.NumberOfPlates)
+	report.Sensors = make([][]Stats, protocol.NumberOfPlates)
+	for plate := range report.Sensors {
+		report.Sensors[plate] = make([]Stats, protocol.SensorsPerPlate)
+	}
+
+	decoder := protocol.NewDecoder()
+	// The decoder skips malformed data byte by byte, every run of skipped bytes is one malformed frame
+	skipping := false
+
+	inspect := func(data []byte) {
+		decoder.Write(data)
+		for {
+			packet, err := decoder.Next()
+			if err != nil {
+				if !skipping {
+					report.addError(err)
+				}
+				skipping = true
+				continue
+			} else if packet == nil {
+				return
+			}
+			skipping = false
+
+			for _, block := range packet.Blocks {
+				if block.Type != protocol.BlockTypeMeasurement {
+					// Responses to requests, recorded by the driver
+					continue
+				}
+				measurement, err := protocol.DecodeMeasurement(block.Data)
+				if err != nil {
+					report.addError(err)
+					continue
+				}
+				report.Frames++
+				for plate, readings := range measurement.Plates {
+					var sum float64
+					for sensor, reading := range readings {
+						report.Sensors[plate][sensor].add(float64(reading))
+						sum += float64(reading)
+					}
+					report.Plates[plate].add(sum)
+				}
+			}
+		}
+	}
+
+	finish := func() {
+		if decoder.Buffered() > 0 && !skipping {
+			report.addError(fmt.Errorf("incomplete packet of %d bytes at the end of the recording", decoder.Buffered()))
+		}
+		for plate := range report.Plates {
+			report.Plates[plate].finish()
+			for sensor := range report.Sensors[plate] {
+				report.Sensors[plate][sensor].finish()
+			}
+		}
+	}
+
+	// Requests do not change how packets are decoded
+	inspectSent := func([]byte) {}
+
+	return inspect, inspectSent, finish
+}
+
+// flexInspector checks that Senso Flex packets consist of whole samples of the current bit depth
+func (report *Report) flexInspector(metadata *Metadata) (func([]byte), func([]byte), func()) {
+	report.Samples = &Stats{}
+	bitDepth := flexprotocol.DefaultBitDepth
+	if metadata != nil && metadata.BitDepth != 0 {
+		bitDepth = metadata.BitDepth
+	}
+
+	inspect := func(data []byte) {
+		sampleLength, ok := flexprotocol.SampleLength(bitDepth)
+		if !ok {
+			report.addError(fmt.Errorf("packet has unsupported bit depth %d", bitDepth))
+			return
+		} else if len(data) == 0 || len(data)%sampleLength != 0 {
+			report.addError(fmt.Errorf("packet has length %d, expected a multiple of %d", len(data), sampleLength))
+			return
+		}
+		report.Frames++
+		for offset := 0; offset < len(data); offset += sampleLength {
+			report.Samples.add(float64(data[offset+2]))
+		}
+	}
+
+	// Sets received after a bit depth command have samples of the new bit depth
+	inspectSent := func(data []byte) {
+		if _, selected, ok := flexprotocol.InterceptBitDepthCommands(data); ok {
+			bitDepth = selected
+		}
+	}
+
+	finish := func() {
+		report.Samples.finish()
+	}
+
+	return inspect, inspectSent, finish
+}
+
+func (stats *Stats) add(value float64) {
+	if stats.Count == 0 || value < stats.Min {
+		stats.Min = value
+	}
+	if stats.Count == 0 || value > stats.Max {
+		stats.Max = value
+	}
+	stats.Count++
+	stats.sum += value
+	stats.sumSquares += value * value
+}
+
+// finish computes mean and deviation from the added values
+func (stats *Stats) finish() {
+	if stats.Count == 0 {
+		return
+	}
+	count := float64(stats.Count)
+	stats.Mean = stats.sum / count
+	stats.Deviation = math.Sqrt(math.Max(stats.sumSquares/count-stats.Mean*stats.Mean, 0))
+}
+
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
+}
+
+func printReport(w io.Writer, report *Report, sensors bool) {
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(table, "File:\t%s\n", report.File)
+	fmt.Fprintf(table, "Version:\t%d\n", report.Version)
+	if report.Metadata != nil {
+		serial := report.Metadata.Serial
+		if serial == "" {
+			serial = "unknown"
+		}
+		fmt.Fprintf(table, "Serial:\t%s\n", serial)
+		fmt.Fprintf(table, "Source:\t%s\n", report.Metadata.Source)
+		fmt.Fprintf(table, "Start time:\t%s\n", report.Metadata.StartTime.Format(time.RFC3339))
+	}
+	fmt.Fprintf(table, "Device:\t%s\n", report.Device)
+	fmt.Fprintf(table, "Duration:\t%.3fs\n", report.Duration/1000)
+	fmt.Fprintf(table, "Packets:\t%d received, %d sent\n", report.Received, report.Sent)
+	fmt.Fprintf(table, "Packet rate:\t%.1f/s\n", report.PacketRate)
+	fmt.Fprintf(table, "Interval:\tmean %.1fms, deviation %.1fms, min %.0fms, max %.0fms\n", report.Interval.Mean, report.Interval.Deviation, report.Interval.Min, report.Interval.Max)
+	fmt.Fprintf(table, "Frames:\t%d\n", report.Frames)
+	fmt.Fprintf(table, "Malformed:\t%d\n", report.Malformed)
+	table.Flush()
+
+	for _, err := range report.Errors {
+		fmt.Fprintf(w, "  %s\n", err)
+	}
+	if report.Malformed > len(report.Errors) {
+		fmt.Fprintf(w, "  ... and %d more\n", report.Malformed-len(report.Errors))
+	}
+
+	fmt.Fprintln(w, "\nIntervals:")
+	lower := 0.0
+	for _, bucket := range report.Histogram {
+		if bucket.Below > 0 {
+			fmt.Fprintf(table, "  %.0f-%.0fms\t%d\n", lower, bucket.Below, bucket.Count)
+			lower = bucket.Below
+		} else {
+			fmt.Fprintf(table, "  >= %.0fms\t%d\n", lower, bucket.Count)
+		}
+	}
+	table.Flush()
+
+	if len(report.Gaps) == 0 {
+		fmt.Fprintln(w, "\nNo gaps.")
+	} else {
+		fmt.Fprintf(w, "\nGaps (%d):\n", len(report.Gaps))
+		for _, gap := range report.Gaps {
+			fmt.Fprintf(table, "  at %.3fs\t%.0fms\n", gap.At/1000, gap.Length)
+		}
+		table.Flush()
+	}
+
+	if report.Plates != nil {
+		fmt.Fprintln(w)
+		fmt.Fprintln(table, "PLATE\tMIN\tMEAN\tMAX")
+		for plate, stats := range report.Plates {
+			fmt.Fprintf(table, "%d\t%.0f\t%.1f\t%.0f\n", plate+1, stats.Min, stats.Mean, stats.Max)
+		}
+		table.Flush()
+	}
+
+	if sensors && report.Sensors != nil {
+		fmt.Fprintln(w)
+		fmt.Fprintln(table, "PLATE\tSENSOR\tMIN\tMEAN\tMAX")
+		for plate, plateSensors := range report.Sensors {
+			for sensor, stats := range plateSensors {
+				fmt.Fprintf(table, "%d\t%d\t%.0f\t%.1f\t%.0f\n", plate+1, sensor+1, stats.Min, stats.Mean, stats.Max)
+			}
+		}
+		table.Flush()
+	}
+
+	if report.Samples != nil {
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "Samples: %d, min %.0f, mean %.1f, max %.0f\n", report.Samples.Count, report.Samples.Min, report.Samples.Mean, report.Samples.Max)
+	}
+}
@@ -0,0 +1,51 @@
+package recording
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestInspectFlexBitDepth(t *testing.T) {
+	var buffer bytes.Buffer
+	writer, err := NewWriter(&buffer, Metadata{Device: "flex", Source: SourceDriver, BitDepth: 12, StartTime: time.Now()}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []Entry{
+		// Samples of 12 bits, as stated in the metadata, are not supported
+		{Time: 0, Direction: DirectionRx, Data: []byte{0, 0, 0x0F, 0xA0, 0, 1, 0, 1, 1, 0, 0, 2}},
+		// 8 bit samples after the bit depth command
+		{Time: 20 * time.Millisecond, Direction: DirectionTx, Data: []byte("S\r\nUL\r\n")},
+		{Time: 40 * time.Millisecond, Direction: DirectionRx, Data: []byte{0, 0, 7, 1, 2, 200}},
+		{Time: 60 * time.Millisecond, Direction: DirectionRx, Data: []byte{0, 0, 1}},
+		// Not a whole number of 8 bit samples
+		{Time: 80 * time.Millisecond, Direction: DirectionRx, Data: []byte{0, 0, 0, 7}},
+	}
+	for _, entry := range entries {
+		if err := writer.WriteAfter(entry.Direction, entry.Data, entry.Time); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Inspect(&buffer, "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Device != "flex" {
+		t.Errorf("inspected as %s, expected flex", report.Device)
+	}
+	if report.Frames != 2 || report.Malformed != 2 {
+		t.Errorf("got %d frames and %d malformed, expected 2 and 2: %v", report.Frames, report.Malformed, report.Errors)
+	}
+	if len(report.Errors) == 0 || report.Errors[0] != "packet has unsupported bit depth 12" {
+		t.Errorf("got errors %v, expected the unsupported bit depth first", report.Errors)
+	}
+	if report.Samples.Count != 3 || report.Samples.Min != 1 || report.Samples.Max != 200 {
+		t.Errorf("got samples %+v, expected 3 from 1 to 200", *report.Samples)
+	}
+}
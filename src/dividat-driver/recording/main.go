@@ -0,0 +1,391 @@
+package recording
+
+/* Reading, writing and replaying recordings of device data.
+
+Recordings are text files with one packet per line, optionally compressed with
+gzip. Two versions of the format exist.
+
+Version 1 recordings, as written by earlier versions of the recorder, have no
+header. Every line holds the milliseconds passed since the previous packet and
+the base64 encoded packet received from the device:
+
+    16, FwYMEwcKCglNCwkRDAk...
+
+Lines without a delay are replayed with a delay of 20ms.
+
+Version 2 recordings start with a line of JSON metadata. Every following line
+holds the milliseconds passed since the start of the recording, measured with
+a monotonic clock, the direction of the packet, `rx` for packets received from
+the device and `tx` for packets sent to it, and the base64 encoded packet:
+
+    {"version":2,"device":"senso","serial":"31-00000001","source":"driver","startTime":"2022-11-01T10:00:00Z"}
+    16, rx, FwYMEwcKCglNCwkRDAk...
+    32, tx, AAEAAAAAAAAAANEA
+
+Only received packets are replayed. Version 1 recordings can be converted with
+the `convert-recording` subcommand (see `convert.go`).
+
+Devices can be replaced by a replayed recording by giving a replay URL in place
+of the device address:
+
+    replay://rec/senso/simple.dat?speed=0.5&loop=false
+
+Relative paths are resolved from the working directory of the driver, absolute
+paths start with a third slash (`replay:///home/user/simple.dat`). Recordings
+are looped, unless `loop=false` is given. Replay URLs given by clients rather
+than on the command line are resolved within the recording directory instead
+(see `ResolveReplayPath`).
+
+*/
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version of the format written by Writer
+const CurrentVersion = 2
+
+// Delay for lines without timing information
+const defaultDelay = 20 * time.Millisecond
+
+// Scheme of URLs that replay a recording in place of a device
+const ReplayScheme = "replay"
+
+// Maximum length of a line, packets are small but recordings may start with an accumulation of packets
+const maxLineLength = 1024 * 1024
+
+// First bytes of gzip compressed data
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Entry is a single recorded packet
+type Entry struct {
+	// Time passed since the start of the recording
+	Time time.Duration
+	// Time passed since the previous entry
+	Delay time.Duration
+	// DirectionRx or DirectionTx, version 1 recordings only contain received packets
+	Direction string
+	Data      []byte
+}
+
+// Reader reads entries from a recording
+type Reader struct {
+	scanner *bufio.Scanner
+	line    int
+	time    time.Duration
+	// Line read while looking for a header, returned by the next call to Next
+	pending *string
+
+	// Version of the format of the recording
+	Version int
+	// Metadata from the header of the recording, nil for version 1 recordings
+	Metadata *Metadata
+}
+
+// NewReader returns a reader for the recording in r, which may be compressed with gzip
+func NewReader(r io.Reader) (*Reader, error) {
+	buffered := bufio.NewReader(r)
+	magic, _ := buffered.Peek(len(gzipMagic))
+
+	var source io.Reader = buffered
+	if string(magic) == string(gzipMagic) {
+		decompressed, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		source = decompressed
+	}
+
+	scanner := bufio.NewScanner(source)
+	scanner.Buffer(make([]byte, 64*1024), maxLineLength)
+	reader := Reader{scanner: scanner, Version: 1}
+
+	err := reader.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	return &reader, nil
+}
+
+// ReadMetadata returns the metadata of the recording at path, nil for version 1 recordings
+func ReadMetadata(path string) (*Metadata, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader, err := NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	return reader.Metadata, nil
+}
+
+// readHeader reads the metadata of version 2 recordings, leaving version 1 recordings untouched
+func (reader *Reader) readHeader() error {
+	// Peeking is not possible with a scanner, so the first line is kept for Next if it is not a header
+	if !reader.scanner.Scan() {
+		return reader.scanner.Err()
+	}
+	reader.line++
+	line := strings.TrimSpace(reader.scanner.Text())
+
+	if !strings.HasPrefix(line, "{") {
+		reader.pending = &line
+		return nil
+	}
+
+	var metadata Metadata
+	err := json.Unmarshal([]byte(line), &metadata)
+	if err != nil {
+		return fmt.Errorf("invalid metadata on line %d: %v", reader.line, err)
+	} else if metadata.Version != CurrentVersion {
+		return fmt.Errorf("unsupported recording version %d", metadata.Version)
+	}
+	reader.Version = metadata.Version
+	reader.Metadata = &metadata
+	return nil
+}
+
+// Next returns the next entry, io.EOF at the end of the recording
+func (reader *Reader) Next() (*Entry, error) {
+	for {
+		var line string
+		if reader.pending != nil {
+			line = *reader.pending
+			reader.pending = nil
+		} else if reader.scanner.Scan() {
+			reader.line++
+			line = strings.TrimSpace(reader.scanner.Text())
+		} else if err := reader.scanner.Err(); err != nil {
+			return nil, err
+		} else {
+			return nil, io.EOF
+		}
+
+		if line == "" {
+			continue
+		}
+
+		if reader.Version == 1 {
+			return reader.parseV1(line)
+		}
+		return reader.parseV2(line)
+	}
+}
+
+// parseV1 parses a line holding an optional delay and a packet
+func (reader *Reader) parseV1(line string) (*Entry, error) {
+	entry := Entry{Delay: defaultDelay, Direction: DirectionRx}
+
+	items := strings.Split(line, ",")
+	if len(items) == 2 {
+		delay, err := strconv.Atoi(strings.TrimSpace(items[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid delay on line %d: %v", reader.line, err)
+		}
+		entry.Delay = time.Duration(delay) * time.Millisecond
+	} else if len(items) != 1 {
+		return nil, fmt.Errorf("invalid packet on line %d", reader.line)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(items[len(items)-1]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid data on line %d: %v", reader.line, err)
+	}
+	entry.Data = data
+
+	reader.time += entry.Delay
+	entry.Time = reader.time
+
+	return &entry, nil
+}
+
+// parseV2 parses a line holding a timestamp, a direction and a packet
+func (reader *Reader) parseV2(line string) (*Entry, error) {
+	items := strings.Split(line, ",")
+	if len(items) != 3 {
+		return nil, fmt.Errorf("invalid packet on line %d", reader.line)
+	}
+
+	timestamp, err := strconv.ParseInt(strings.TrimSpace(items[0]), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp on line %d: %v", reader.line, err)
+	}
+	entryTime := time.Duration(timestamp) * time.Millisecond
+	if entryTime < reader.time {
+		return nil, fmt.Errorf("timestamp on line %d is before the previous timestamp", reader.line)
+	}
+
+	direction := strings.TrimSpace(items[1])
+	if direction != DirectionRx && direction != DirectionTx {
+		return nil, fmt.Errorf("invalid direction on line %d: %s", reader.line, direction)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(items[2]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid data on line %d: %v", reader.line, err)
+	}
+
+	entry := Entry{
+		Time:      entryTime,
+		Delay:     entryTime - reader.time,
+		Direction: direction,
+		Data:      data,
+	}
+	reader.time = entryTime
+
+	return &entry, nil
+}
+
+// ReplayOptions describe a recording to replay in place of a device
+type ReplayOptions struct {
+	Path  string
+	Speed float64
+	Loop  bool
+}
+
+// IsReplayURL returns true if address is a replay URL rather than the address of a device
+func IsReplayURL(address string) bool {
+	return strings.HasPrefix(address, ReplayScheme+"://")
+}
+
+// ParseReplayURL parses a replay URL, like `replay://rec/senso/simple.dat?speed=0.5&loop=false`
+func ParseReplayURL(address string) (*ReplayOptions, error) {
+	if !IsReplayURL(address) {
+		return nil, fmt.Errorf("not a replay URL: %s", address)
+	}
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	// The first segment of relative paths is parsed as host
+	options := ReplayOptions{Path: parsed.Host + parsed.Path, Speed: 1, Loop: true}
+	if options.Path == "" {
+		return nil, fmt.Errorf("no recording given in replay URL: %s", address)
+	}
+
+	query := parsed.Query()
+	if speed := query.Get("speed"); speed != "" {
+		options.Speed, err = strconv.ParseFloat(speed, 64)
+		if err != nil || options.Speed <= 0 {
+			return nil, fmt.Errorf("invalid replay speed: %s", speed)
+		}
+	}
+	if loop := query.Get("loop"); loop != "" {
+		options.Loop, err = strconv.ParseBool(loop)
+		if err != nil {
+			return nil, fmt.Errorf("invalid replay loop: %s", loop)
+		}
+	}
+
+	return &options, nil
+}
+
+// ResolveReplayPath resolves the path of a replay URL given by a client within dir.
+//
+// Absolute paths and paths leaving dir are refused, so that clients can only
+// replay recordings stored in dir.
+func ResolveReplayPath(dir string, path string) (string, error) {
+	if filepath.IsAbs(path) || filepath.VolumeName(path) != "" || strings.HasPrefix(path, "/") {
+		return "", fmt.Errorf("replay path must be relative to the recording directory: %s", path)
+	}
+	segments := strings.FieldsFunc(path, func(r rune) bool {
+		return r == '/' || r == filepath.Separator
+	})
+	for _, segment := range segments {
+		if segment == ".." {
+			return "", fmt.Errorf("replay path must not leave the recording directory: %s", path)
+		}
+	}
+	return filepath.Join(dir, path), nil
+}
+
+// Replay sends the packets of the recording at path with their recorded timing.
+//
+// Delays are divided by speed. If loop is set, the recording starts over when
+// it ends, otherwise Replay returns at the end of the recording.
+func Replay(ctx context.Context, path string, speed float64, loop bool, send func([]byte)) error {
+	return ReplayWithSent(ctx, path, speed, loop, nil, send, nil)
+}
+
+// ReplayWithSent replays like Replay, so that replayers can follow how the packets were to be decoded.
+//
+// Before every pass over the recording, onStart is called with its metadata, nil for version 1 recordings. Sent
+// packets are passed to onSent in the order they were recorded in, without delay. Both may be nil.
+func ReplayWithSent(ctx context.Context, path string, speed float64, loop bool, onStart func(*Metadata), send func([]byte), onSent func([]byte)) error {
+	if speed <= 0 {
+		return fmt.Errorf("invalid replay speed %v", speed)
+	}
+
+	for {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		sent := 0
+		reader, err := NewReader(file)
+		if err == nil {
+			if onStart != nil {
+				onStart(reader.Metadata)
+			}
+			sent, err = replayFile(ctx, reader, speed, send, onSent)
+		}
+		file.Close()
+		if err != nil {
+			return err
+		} else if sent == 0 {
+			// Looping over a recording without received packets would never pause
+			return fmt.Errorf("no received packets to replay in %s", path)
+		}
+
+		if !loop {
+			return nil
+		}
+	}
+}
+
+// replayFile sends the received packets of a recording, returning how many have been sent, and passes on sent packets
+func replayFile(ctx context.Context, reader *Reader, speed float64, send func([]byte), onSent func([]byte)) (int, error) {
+	// Schedule packets relative to the start of the replay, so that delays in sending do not accumulate
+	start := time.Now()
+	sent := 0
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			return sent, nil
+		} else if err != nil {
+			return sent, err
+		}
+
+		if entry.Direction != DirectionRx {
+			if onSent != nil {
+				onSent(entry.Data)
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return sent, ctx.Err()
+		case <-time.After(time.Until(start.Add(time.Duration(float64(entry.Time) / speed)))):
+			send(entry.Data)
+			sent++
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package recording
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeRecording writes a recording with the given entries to a new temporary directory and returns its path
+func writeRecording(t *testing.T, entries []Entry) string {
+	dir, err := ioutil.TempDir("", "dividat-driver-recording-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "recording.dat")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	writer, err := NewWriter(file, Metadata{Device: "senso", Source: SourceDriver, StartTime: time.Now()}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if err := writer.WriteAfter(entry.Direction, entry.Data, entry.Time); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReplay(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []Entry
+		loop    bool
+		sent    [][]byte
+		err     bool
+	}{
+		{
+			name: "received packets",
+			entries: []Entry{
+				{Time: 0, Direction: DirectionRx, Data: []byte{1}},
+				{Time: time.Millisecond, Direction: DirectionTx, Data: []byte{2}},
+				{Time: 2 * time.Millisecond, Direction: DirectionRx, Data: []byte{3}},
+			},
+			sent: [][]byte{{1}, {3}},
+		},
+		{
+			name: "no packets",
+			err:  true,
+		},
+		{
+			name: "no packets, looping",
+			loop: true,
+			err:  true,
+		},
+		{
+			name: "only sent packets, looping",
+			entries: []Entry{
+				{Time: 0, Direction: DirectionTx, Data: []byte{1}},
+			},
+			loop: true,
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeRecording(t, test.entries)
+			defer os.RemoveAll(filepath.Dir(path))
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			var sent [][]byte
+			err := Replay(ctx, path, 1, test.loop, func(data []byte) {
+				sent = append(sent, data)
+			})
+
+			if ctx.Err() != nil {
+				t.Fatal("replay did not return")
+			} else if test.err && err == nil {
+				t.Error("expected an error")
+			} else if !test.err && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(sent, test.sent) {
+				t.Errorf("sent %v, expected %v", sent, test.sent)
+			}
+		})
+	}
+}
+
+func TestResolveReplayPath(t *testing.T) {
+	dir := filepath.Join("rec", "senso")
+	tests := []struct {
+		path     string
+		resolved string
+		err      bool
+	}{
+		{path: "zero.dat", resolved: filepath.Join(dir, "zero.dat")},
+		{path: "2024/zero.dat", resolved: filepath.Join(dir, "2024", "zero.dat")},
+		{path: "/etc/passwd", err: true},
+		{path: "../flex/zero.dat", err: true},
+		{path: "2024/../../flex/zero.dat", err: true},
+		{path: "..", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			resolved, err := ResolveReplayPath(dir, test.path)
+			if test.err && err == nil {
+				t.Errorf("resolved to %s, expected an error", resolved)
+			} else if !test.err && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if resolved != test.resolved {
+				t.Errorf("resolved to %s, expected %s", resolved, test.resolved)
+			}
+		})
+	}
+}
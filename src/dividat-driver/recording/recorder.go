@@ -0,0 +1,362 @@
+package recording
+
+/* Recording device streams in the running driver.
+
+Every device handle has a recorder, controlled with HTTP requests below the
+path of the device, for example `/senso/record`:
+
+    POST /senso/record/start   start recording, responds with the recording
+    POST /senso/record/stop    stop recording, responds with the recording
+    GET  /senso/record         list recordings and the active recording
+    GET  /senso/record/{name}  download a recording
+
+Recordings are stored in the recording directory, named after the device, the
+serial of the device and the start time, in the current version of the recording
+format. Serials are reported by devices or given by clients, so they are only
+included in the name if they consist of letters, digits, dots, dashes and
+underscores.
+
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// File extensions of recordings
+const recordingExtension = ".dat"
+const compressedExtension = ".dat.gz"
+
+// Format of the start time in names of recordings
+const startTimeFormat = "20060102T150405Z"
+
+// Serials that may be included in names of recordings, without path separators and not starting with a dot
+var nameSerialPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Errors when starting or stopping recordings
+var (
+	ErrRecording    = errors.New("Already recording.")
+	ErrNotRecording = errors.New("Not recording.")
+	ErrClosed       = errors.New("Recorder has been closed.")
+)
+
+// Config for recorders
+type Config struct {
+	// Directory in which recordings are stored
+	Dir string
+	// Version of the driver, included in the metadata of recordings
+	DriverVersion string
+	// Compress recordings with gzip
+	Compress bool
+	// Counts recorders that have not finished their recording since their context is done, optional
+	Stopped *sync.WaitGroup
+}
+
+// DefaultDir returns the directory in which recordings are stored by default
+func DefaultDir() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		configDir = os.TempDir()
+	}
+	return filepath.Join(configDir, "dividat-driver", "recordings")
+}
+
+// Recording describes a stored recording
+type Recording struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	StartTime time.Time `json:"startTime"`
+	// Number of recorded packets, only known for the active recording
+	Packets int `json:"packets,omitempty"`
+}
+
+// Recorder records the packets of a device to files
+type Recorder struct {
+	ctx    context.Context
+	config Config
+	device string
+	// Fills in device specific metadata when a recording is started
+	describe func(*Metadata)
+
+	// Active recording, guarded by mutex
+	active *Recording
+	file   *os.File
+	writer *Writer
+	mutex  *sync.Mutex
+
+	log *logrus.Entry
+}
+
+// NewRecorder returns a recorder for the kind of device, the active recording is stopped once ctx is done
+func NewRecorder(ctx context.Context, log *logrus.Entry, config Config, device string, describe func(*Metadata)) *Recorder {
+	recorder := &Recorder{
+		ctx:      ctx,
+		config:   config,
+		device:   device,
+		describe: describe,
+		mutex:    &sync.Mutex{},
+		log:      log,
+	}
+
+	if config.Stopped != nil {
+		config.Stopped.Add(1)
+	}
+	go func() {
+		<-ctx.Done()
+		// Flush and close the recording, so that it is not left truncated
+		recorder.Stop()
+		if config.Stopped != nil {
+			config.Stopped.Done()
+		}
+	}()
+
+	return recorder
+}
+
+// Start a recording, fails if a recording is active
+func (recorder *Recorder) Start() (*Recording, error) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	if recorder.ctx.Err() != nil {
+		return nil, ErrClosed
+	} else if recorder.active != nil {
+		return nil, ErrRecording
+	}
+
+	metadata := Metadata{
+		Device:        recorder.device,
+		Source:        SourceDriver,
+		DriverVersion: recorder.config.DriverVersion,
+		StartTime:     time.Now(),
+	}
+	if recorder.describe != nil {
+		recorder.describe(&metadata)
+	}
+
+	name := recorder.device
+	if nameSerialPattern.MatchString(metadata.Serial) {
+		name += "-" + metadata.Serial
+	} else if metadata.Serial != "" {
+		recorder.log.WithField("serial", metadata.Serial).Warning("Serial not included in the name of the recording.")
+	}
+	name += "-" + metadata.StartTime.UTC().Format(startTimeFormat)
+	if recorder.config.Compress {
+		name += compressedExtension
+	} else {
+		name += recordingExtension
+	}
+
+	err := os.MkdirAll(recorder.config.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Create(filepath.Join(recorder.config.Dir, name))
+	if err != nil {
+		return nil, err
+	}
+	writer, err := NewWriter(file, metadata, recorder.config.Compress)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	recorder.active = &Recording{Name: name, StartTime: metadata.StartTime}
+	recorder.file = file
+	recorder.writer = writer
+
+	recorder.log.WithField("recording", name).Info("Started recording.")
+	return recorder.snapshot(), nil
+}
+
+// Stop the active recording, fails if there is none
+func (recorder *Recorder) Stop() (*Recording, error) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	if recorder.active == nil {
+		return nil, ErrNotRecording
+	}
+
+	err := recorder.writer.Close()
+	recording := recorder.snapshot()
+	closeErr := recorder.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	recorder.active = nil
+	recorder.file = nil
+	recorder.writer = nil
+
+	if err != nil {
+		recorder.log.WithError(err).WithField("recording", recording.Name).Error("Could not finish recording.")
+		return nil, err
+	}
+
+	recorder.log.WithField("recording", recording.Name).WithField("packets", recording.Packets).Info("Stopped recording.")
+	return recording, nil
+}
+
+// Record a packet, if a recording is active
+func (recorder *Recorder) Record(direction string, data []byte) {
+	now := time.Now()
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	if recorder.active == nil {
+		return
+	}
+
+	err := recorder.writer.Write(direction, data, now)
+	if err != nil {
+		recorder.log.WithError(err).WithField("recording", recorder.active.Name).Warning("Could not record packet.")
+		return
+	}
+	recorder.active.Packets++
+}
+
+// snapshot returns a copy of the active recording with its current size, the caller must hold the mutex
+func (recorder *Recorder) snapshot() *Recording {
+	recording := *recorder.active
+	if info, err := recorder.file.Stat(); err == nil {
+		recording.Size = info.Size()
+	}
+	return &recording
+}
+
+// Active returns the active recording, nil if not recording
+func (recorder *Recorder) Active() *Recording {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	if recorder.active == nil {
+		return nil
+	}
+	return recorder.snapshot()
+}
+
+// List the stored recordings of the device, most recent first
+func (recorder *Recorder) List() ([]Recording, error) {
+	recordings := []Recording{}
+
+	infos, err := ioutil.ReadDir(recorder.config.Dir)
+	if os.IsNotExist(err) {
+		return recordings, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, info := range infos {
+		if !recorder.isRecording(info.Name()) || info.IsDir() {
+			continue
+		}
+		recordings = append(recordings, Recording{
+			Name:      info.Name(),
+			Size:      info.Size(),
+			StartTime: nameStartTime(info.Name()),
+		})
+	}
+
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Name > recordings[j].Name
+	})
+	return recordings, nil
+}
+
+// isRecording returns true if name is the name of a recording of the device
+func (recorder *Recorder) isRecording(name string) bool {
+	hasExtension := strings.HasSuffix(name, recordingExtension) || strings.HasSuffix(name, compressedExtension)
+	return strings.HasPrefix(name, recorder.device+"-") && hasExtension && filepath.Base(name) == name
+}
+
+// nameStartTime returns the start time stated in the name of a recording
+func nameStartTime(name string) time.Time {
+	name = strings.TrimSuffix(strings.TrimSuffix(name, compressedExtension), recordingExtension)
+	startTime, _ := time.Parse(startTimeFormat, name[strings.LastIndex(name, "-")+1:])
+	return startTime
+}
+
+// HTTP
+
+// Serve requests to the recorder, path is the part of the request path after `record`
+func (recorder *Recorder) Serve(w http.ResponseWriter, r *http.Request, path string) {
+	path = strings.TrimPrefix(path, "/")
+
+	if r.Method == "POST" && path == "start" {
+		recording, err := recorder.Start()
+		if err == ErrRecording {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else if err != nil {
+			http.Error(w, "Could not start recording: "+err.Error(), http.StatusInternalServerError)
+		} else {
+			writeJSON(w, http.StatusCreated, recording)
+		}
+
+	} else if r.Method == "POST" && path == "stop" {
+		recording, err := recorder.Stop()
+		if err == ErrNotRecording {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else if err != nil {
+			http.Error(w, "Could not stop recording: "+err.Error(), http.StatusInternalServerError)
+		} else {
+			writeJSON(w, http.StatusOK, recording)
+		}
+
+	} else if r.Method == "GET" && path == "" {
+		recordings, err := recorder.List()
+		if err != nil {
+			http.Error(w, "Could not list recordings: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, &struct {
+			Active     *Recording  `json:"active"`
+			Recordings []Recording `json:"recordings"`
+		}{
+			Active:     recorder.Active(),
+			Recordings: recordings,
+		})
+
+	} else if r.Method == "GET" && recorder.isRecording(path) {
+		file, err := os.Open(filepath.Join(recorder.config.Dir, path))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+path+"\"")
+		if strings.HasSuffix(path, compressedExtension) {
+			w.Header().Set("Content-Type", "application/gzip")
+		} else {
+			w.Header().Set("Content-Type", "text/plain")
+		}
+		http.ServeContent(w, r, path, info.ModTime(), file)
+
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	body, _ := json.Marshal(value)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,64 @@
+package recording
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRecorderName(t *testing.T) {
+	tests := []struct {
+		serial string
+		prefix string
+	}{
+		{serial: "31-00000121", prefix: "senso-31-00000121-"},
+		{serial: "FLX_1.2", prefix: "senso-FLX_1.2-"},
+		{serial: "", prefix: "senso-2"},
+		{serial: "../../escaped", prefix: "senso-2"},
+		{serial: "..", prefix: "senso-2"},
+		{serial: "a/b", prefix: "senso-2"},
+		{serial: `a\b`, prefix: "senso-2"},
+	}
+
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+
+	for _, test := range tests {
+		t.Run(test.serial, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "dividat-driver-recorder-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			recordingDir := filepath.Join(dir, "recordings")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			recorder := NewRecorder(ctx, logrus.NewEntry(log), Config{Dir: recordingDir}, "senso", func(metadata *Metadata) {
+				metadata.Serial = test.serial
+			})
+
+			recording, err := recorder.Start()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := recorder.Stop(); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(recording.Name) < len(test.prefix) || recording.Name[:len(test.prefix)] != test.prefix {
+				t.Errorf("recording named %s, expected it to start with %s", recording.Name, test.prefix)
+			}
+			// The recording is the only file written, directly in the recording directory
+			files, _ := filepath.Glob(filepath.Join(dir, "*"))
+			recordings, _ := filepath.Glob(filepath.Join(recordingDir, "*"))
+			if len(files) != 1 || len(recordings) != 1 || filepath.Base(recordings[0]) != recording.Name {
+				t.Errorf("found %v and %v, expected only %s in the recording directory", files, recordings, recording.Name)
+			}
+		})
+	}
+}
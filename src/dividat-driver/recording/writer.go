@@ -0,0 +1,103 @@
+package recording
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Directions of recorded packets
+const (
+	// Received from the device
+	DirectionRx = "rx"
+	// Sent to the device
+	DirectionTx = "tx"
+)
+
+// Sources of recordings
+const (
+	// Recorded by the running driver
+	SourceDriver = "driver"
+	// Converted from a version 1 recording
+	SourceConverted = "converted"
+)
+
+// Metadata describing a recording, written as its first line
+type Metadata struct {
+	// Version of the recording format
+	Version int `json:"version"`
+	// Kind of device, senso or flex
+	Device   string `json:"device"`
+	Serial   string `json:"serial,omitempty"`
+	Firmware string `json:"firmware,omitempty"`
+	// Bit depth of Senso Flex samples at the start of the recording, changed by recorded bit depth commands
+	BitDepth int `json:"bitDepth,omitempty"`
+	// Where the samples were recorded, SourceDriver, SourceConverted or the URL of the WebSocket the recorder was connected to
+	Source        string    `json:"source"`
+	DriverVersion string    `json:"driverVersion,omitempty"`
+	StartTime     time.Time `json:"startTime"`
+}
+
+// Writer writes packets to a recording in the current version of the format
+type Writer struct {
+	writer     *bufio.Writer
+	compressor *gzip.Writer
+	start      time.Time
+}
+
+// NewWriter writes the metadata header to w and returns a writer for the packets.
+//
+// If compress is set, the recording is compressed with gzip. Close must be called to complete the recording.
+func NewWriter(w io.Writer, metadata Metadata, compress bool) (*Writer, error) {
+	writer := Writer{start: metadata.StartTime}
+	if compress {
+		writer.compressor = gzip.NewWriter(w)
+		w = writer.compressor
+	}
+	writer.writer = bufio.NewWriter(w)
+
+	metadata.Version = CurrentVersion
+	header, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Fprintf(writer.writer, "%s\n", header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &writer, nil
+}
+
+// Write a packet sent in direction at time at, which must not be before the start time of the recording
+func (writer *Writer) Write(direction string, data []byte, at time.Time) error {
+	return writer.WriteAfter(direction, data, at.Sub(writer.start))
+}
+
+// WriteAfter writes a packet sent in direction after elapsed time since the start of the recording
+func (writer *Writer) WriteAfter(direction string, data []byte, elapsed time.Duration) error {
+	_, err := fmt.Fprintf(writer.writer, "%d, %s, %s\n", elapsed.Nanoseconds()/int64(time.Millisecond), direction, base64.StdEncoding.EncodeToString(data))
+	return err
+}
+
+// Flush buffered packets
+func (writer *Writer) Flush() error {
+	err := writer.writer.Flush()
+	if err == nil && writer.compressor != nil {
+		err = writer.compressor.Flush()
+	}
+	return err
+}
+
+// Close completes the recording, without closing the underlying writer
+func (writer *Writer) Close() error {
+	err := writer.writer.Flush()
+	if err == nil && writer.compressor != nil {
+		err = writer.compressor.Close()
+	}
+	return err
+}
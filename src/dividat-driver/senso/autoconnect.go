@@ -0,0 +1,265 @@
+package senso
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dividat/driver/src/dividat-driver/recording"
+)
+
+// Config for the Senso handle
+type Config struct {
+	// Connect to the last connected Senso on startup, or to the only Senso that can be discovered
+	AutoConnect bool
+	// File in which the last connected Senso is remembered when auto-connecting
+	StatePath string
+	// Where recordings are stored
+	Recording recording.Config
+}
+
+// DefaultStatePath returns the path of the file remembering the last connected Senso
+func DefaultStatePath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		configDir = os.TempDir()
+	}
+	return filepath.Join(configDir, "dividat-driver", "senso.json")
+}
+
+// How long to browse when auto-connecting to a discovered Senso
+const autoDiscoveryDuration = 10 * time.Second
+
+// How long to wait between attempts to discover a Senso for auto-connecting
+const autoDiscoveryInterval = 30 * time.Second
+
+// How long to browse when resolving the serial of a pinned connection
+const resolveTimeout = 10 * time.Second
+
+// How long to wait before trying again to resolve the serial of a Senso that could not be found
+const resolveRetryInterval = 10 * time.Second
+
+// Number of consecutive failed connection attempts after which the serial of a pinned connection is resolved again
+const resolveAfterFailures = 3
+
+// rememberedSenso is persisted to the state file
+type rememberedSenso struct {
+	Address string `json:"address"`
+	Serial  string `json:"serial"`
+}
+
+// autoConnect connects to the remembered Senso, or otherwise keeps looking for a single Senso on the network
+func (handle *Handle) autoConnect() {
+	log := handle.log.WithField("statePath", handle.config.StatePath)
+
+	remembered, err := loadRemembered(handle.config.StatePath)
+	if err == nil {
+		log.WithField("address", remembered.Address).WithField("serial", remembered.Serial).Info("Auto-connecting to remembered Senso.")
+		handle.connect(remembered.Address, remembered.Serial)
+		return
+	} else if !os.IsNotExist(err) {
+		log.WithError(err).Warning("Could not read remembered Senso.")
+	}
+
+	for {
+		ctx, cancel := context.WithTimeout(handle.ctx, autoDiscoveryDuration)
+		serial, address, err := handle.discoverSingle(ctx)
+		cancel()
+
+		if err == nil {
+			handle.connectionChangeMutex.Lock()
+			// Do not interfere if a client has connected in the meantime
+			if handle.Address == nil {
+				log.WithField("address", address).WithField("serial", serial).Info("Auto-connecting to discovered Senso.")
+				handle.connectLocked(address, serial)
+			}
+			handle.connectionChangeMutex.Unlock()
+			return
+		}
+
+		log.WithError(err).Info("Could not auto-connect to a discovered Senso.")
+
+		select {
+		case <-handle.ctx.Done():
+			return
+		case <-time.After(autoDiscoveryInterval):
+		}
+	}
+}
+
+// trackPinnedConnection resolves the serial of a pinned connection again after repeated failures to connect
+func (handle *Handle) trackPinnedConnection(connectionId int, address string, state ConnectionState) {
+	handle.connectionMutex.Lock()
+	if connectionId != handle.connectionId || handle.pinnedSerial == "" {
+		handle.connectionMutex.Unlock()
+		return
+	}
+	if state.State == StateConnected {
+		handle.connectionFailures = 0
+	} else if state.State == StateBackoff {
+		handle.connectionFailures++
+	}
+	serial := handle.pinnedSerial
+	failures := handle.connectionFailures
+	handle.connectionMutex.Unlock()
+
+	if state.State == StateBackoff && failures%resolveAfterFailures == 0 {
+		handle.log.WithField("serial", serial).WithField("failures", failures).Info("Can not reach pinned Senso, resolving its address.")
+		go handle.followSerial(connectionId, serial, address)
+	}
+}
+
+// onSerialReported handles the serial reported by the connected Senso
+func (handle *Handle) onSerialReported(serial string) {
+	handle.connectionMutex.Lock()
+	connectionId := handle.connectionId
+	pinnedSerial := handle.pinnedSerial
+	handle.connectionMutex.Unlock()
+
+	address := handle.Address
+	if address == nil || serial == "" {
+		return
+	}
+
+	if pinnedSerial != "" && serial != pinnedSerial {
+		// Another Senso has taken over the address
+		handle.log.WithField("serial", serial).WithField("pinnedSerial", pinnedSerial).Info("Connected Senso does not have pinned serial, resolving its address.")
+		go handle.followSerial(connectionId, pinnedSerial, *address)
+		return
+	}
+
+	// Replays are not remembered, so that a real Senso is connected on the next start
+	if handle.config.AutoConnect && !recording.IsReplayURL(*address) {
+		err := saveRemembered(handle.config.StatePath, rememberedSenso{Address: *address, Serial: serial})
+		if err != nil {
+			handle.log.WithError(err).Warning("Could not remember connected Senso.")
+		}
+	}
+}
+
+// followSerial reconnects a pinned connection if its Senso can be found at a new address
+func (handle *Handle) followSerial(connectionId int, serial string, currentAddress string) {
+	handle.connectionMutex.Lock()
+	if handle.resolvingSerial {
+		handle.connectionMutex.Unlock()
+		return
+	}
+	handle.resolvingSerial = true
+	handle.connectionMutex.Unlock()
+
+	defer func() {
+		handle.connectionMutex.Lock()
+		handle.resolvingSerial = false
+		handle.connectionMutex.Unlock()
+	}()
+
+	log := handle.log.WithField("serial", serial)
+
+	ctx, cancel := context.WithTimeout(handle.ctx, resolveTimeout)
+	address, err := handle.resolveSerial(ctx, serial)
+	cancel()
+	if err != nil {
+		log.WithError(err).Info("Could not resolve address of pinned Senso.")
+		return
+	} else if address == currentAddress {
+		log.WithField("address", address).Debug("Pinned Senso has not changed its address.")
+		return
+	}
+
+	handle.connectionChangeMutex.Lock()
+	defer handle.connectionChangeMutex.Unlock()
+
+	// Only switch if the connection has not been changed in the meantime
+	handle.connectionMutex.Lock()
+	isCurrent := connectionId == handle.connectionId && serial == handle.pinnedSerial
+	handle.connectionMutex.Unlock()
+
+	if isCurrent {
+		log.WithField("address", address).Info("Pinned Senso has moved to a new address.")
+		handle.connectLocked(address, serial)
+	}
+}
+
+// resolveAndConnect looks for the Senso with serial until it is found and connected or ctx is done
+func (handle *Handle) resolveAndConnect(ctx context.Context, connectionId int, serial string) {
+	log := handle.log.WithField("serial", serial)
+
+	setState := func(state ConnectionState) {
+		handle.setChannelState(connectionId, ChannelData, state)
+		handle.setChannelState(connectionId, ChannelControl, state)
+	}
+
+	for {
+		setState(ConnectionState{State: StateResolving})
+
+		address := handle.registryAddress(serial)
+		var err error
+		if address == "" {
+			resolveCtx, cancel := context.WithTimeout(ctx, resolveTimeout)
+			address, err = handle.resolveSerial(resolveCtx, serial)
+			cancel()
+		}
+
+		if err == nil {
+			handle.connectionChangeMutex.Lock()
+			// Only connect if the connection has not been changed in the meantime
+			handle.connectionMutex.Lock()
+			isCurrent := connectionId == handle.connectionId && serial == handle.pinnedSerial
+			handle.connectionMutex.Unlock()
+			if isCurrent && ctx.Err() == nil {
+				log.WithField("address", address).Info("Resolved address of Senso.")
+				handle.connectLocked(address, serial)
+			}
+			handle.connectionChangeMutex.Unlock()
+			return
+		} else if ctx.Err() != nil {
+			return
+		}
+
+		log.WithError(err).Info("Could not resolve address of Senso.")
+		nextRetry := time.Now().Add(resolveRetryInterval)
+		setState(ConnectionState{State: StateBackoff, NextRetry: &nextRetry, Error: err.Error()})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(resolveRetryInterval):
+		}
+	}
+}
+
+func loadRemembered(path string) (*rememberedSenso, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var remembered rememberedSenso
+	err = json.Unmarshal(data, &remembered)
+	if err != nil {
+		return nil, err
+	}
+
+	return &remembered, nil
+}
+
+func saveRemembered(path string, remembered rememberedSenso) error {
+	if current, err := loadRemembered(path); err == nil && *current == remembered {
+		return nil
+	}
+
+	data, err := json.Marshal(&remembered)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,133 @@
+package senso
+
+import (
+	"context"
+	"time"
+
+	"github.com/dividat/driver/src/dividat-driver/recording"
+	"github.com/dividat/driver/src/dividat-driver/senso/protocol"
+)
+
+// How long to wait for Senso to respond to a command, unless the command specifies a timeout
+const defaultCommandTimeout = 2 * time.Second
+
+// How long writing a command to the control channel may take
+const commandWriteTimeout = 500 * time.Millisecond
+
+// Number of commands that can wait for being written to the control channel
+const commandQueueSize = 32
+
+// Outcomes of a command
+const (
+	// Command was written and Senso responded
+	CommandAcknowledged = "Acknowledged"
+	// Command could not be written to Senso
+	CommandNotDelivered = "NotDelivered"
+	// Command was written, but Senso did not respond in time
+	CommandTimeout = "Timeout"
+)
+
+// CommandResult reports the outcome of a command sent with SendCommand
+type CommandResult struct {
+	// Correlation ID given with the command
+	Id     string
+	Status string
+	Error  string
+	// Response of Senso, if the command was acknowledged
+	Response *Response
+}
+
+// queuedWrite is data waiting to be written to the control channel, the outcome of writing is sent to done
+type queuedWrite struct {
+	data     []byte
+	deadline time.Time
+	done     chan error
+}
+
+// pendingCommand waits for a response block of a type
+type pendingCommand struct {
+	responseType uint16
+	response     chan protocol.Block
+}
+
+// SendCommand writes a request block to the control channel and waits for the response of Senso.
+//
+// Commands are written in order. Writes wait in a queue while Senso is not connected, until the timeout expires.
+func (handle *Handle) SendCommand(parentCtx context.Context, blockType uint16, data []byte, timeout time.Duration) CommandResult {
+	ctx, cancel := context.WithTimeout(parentCtx, timeout)
+	defer cancel()
+
+	// Wait for the response before writing, so that a fast response is not missed
+	pending := handle.addPending(blockType | protocol.ResponseFlag)
+	defer handle.removePending(pending)
+
+	write := &queuedWrite{
+		data: protocol.NewRequest(blockType, data).Encode(),
+		done: make(chan error, 1),
+	}
+	write.deadline, _ = ctx.Deadline()
+
+	select {
+	case handle.commandQueue <- write:
+	case <-ctx.Done():
+		return CommandResult{Status: CommandNotDelivered, Error: "Command queue is full."}
+	}
+
+	select {
+	case err := <-write.done:
+		if err != nil {
+			return CommandResult{Status: CommandNotDelivered, Error: err.Error()}
+		}
+		handle.recorder.Record(recording.DirectionTx, write.data)
+	case <-ctx.Done():
+		return CommandResult{Status: CommandNotDelivered, Error: "Command could not be written before the timeout, Senso may not be connected."}
+	}
+
+	select {
+	case block := <-pending.response:
+		return CommandResult{Status: CommandAcknowledged, Response: blockMessage(handle.log, block).Response}
+	case <-ctx.Done():
+		return CommandResult{Status: CommandTimeout, Error: "Senso did not respond."}
+	}
+}
+
+// addPending registers a command waiting for a response block of responseType
+func (handle *Handle) addPending(responseType uint16) *pendingCommand {
+	pending := &pendingCommand{
+		responseType: responseType,
+		response:     make(chan protocol.Block, 1),
+	}
+
+	handle.pendingMutex.Lock()
+	handle.pending = append(handle.pending, pending)
+	handle.pendingMutex.Unlock()
+
+	return pending
+}
+
+// removePending stops waiting for a response
+func (handle *Handle) removePending(pending *pendingCommand) {
+	handle.pendingMutex.Lock()
+	defer handle.pendingMutex.Unlock()
+
+	for ix, p := range handle.pending {
+		if p == pending {
+			handle.pending = append(handle.pending[:ix], handle.pending[ix+1:]...)
+			return
+		}
+	}
+}
+
+// resolvePending hands a response block to the oldest command waiting for it
+func (handle *Handle) resolvePending(block protocol.Block) {
+	handle.pendingMutex.Lock()
+	defer handle.pendingMutex.Unlock()
+
+	for ix, pending := range handle.pending {
+		if pending.responseType == block.Type {
+			handle.pending = append(handle.pending[:ix], handle.pending[ix+1:]...)
+			pending.response <- block
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package senso
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/dividat/driver/src/dividat-driver/senso/protocol"
+)
+
+// Device holds information queried from the connected Senso
+type Device struct {
+	// Serial numbers and firmware versions of the controller and LED boards
+	DevInfo *protocol.DevInfo `json:"devInfo"`
+	// Voltages and temperatures of the controller and LED boards
+	VccInfo *protocol.VccInfo `json:"vccInfo"`
+}
+
+// queryDevice requests device information on the control channel, responses are picked up by updateDevice
+func (handle *Handle) queryDevice() {
+	handle.log.Debug("Querying device information.")
+	handle.transmit(protocol.NewRequest(protocol.BlockTypeDevInfo, nil).Encode())
+	handle.transmit(protocol.NewRequest(protocol.BlockTypeVccInfo, nil).Encode())
+}
+
+// updateDevice caches device information from a decoded response payload
+func (handle *Handle) updateDevice(payload interface{}) {
+	handle.deviceMutex.Lock()
+
+	device := Device{}
+	if handle.device != nil {
+		device = *handle.device
+	}
+
+	switch info := payload.(type) {
+	case *protocol.DevInfo:
+		device.DevInfo = info
+		handle.log.WithField("serial", info.Controller.SerialNumber).WithField("firmware", info.Controller.SoftwareVersion.String()).Info("Received device information.")
+	case *protocol.VccInfo:
+		device.VccInfo = info
+	default:
+		handle.deviceMutex.Unlock()
+		return
+	}
+
+	handle.device = &device
+	handle.deviceMutex.Unlock()
+
+	if devInfo, ok := payload.(*protocol.DevInfo); ok {
+		handle.onSerialReported(devInfo.Controller.SerialNumber)
+	}
+}
+
+// setDevice replaces cached device information
+func (handle *Handle) setDevice(device *Device) {
+	handle.deviceMutex.Lock()
+	handle.device = device
+	handle.deviceMutex.Unlock()
+}
+
+// GetDevice returns information about the connected Senso, nil if none has been received yet
+func (handle *Handle) GetDevice() *Device {
+	handle.deviceMutex.RLock()
+	defer handle.deviceMutex.RUnlock()
+	return handle.device
+}
+
+// ServeDevice responds with information about the connected Senso
+func (handle *Handle) ServeDevice(w http.ResponseWriter, r *http.Request) {
+	device := handle.GetDevice()
+	if device == nil {
+		device = &Device{}
+	}
+
+	deviceJson, _ := json.Marshal(&struct {
+		Address *string `json:"address"`
+		*Device
+	}{
+		Address: handle.Address,
+		Device:  device,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(deviceJson)
+}
@@ -2,6 +2,9 @@ package senso
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
 
 	"github.com/grandcat/zeroconf"
 )
@@ -11,16 +14,18 @@ func (handle *Handle) Discover(ctx context.Context) chan *zeroconf.ServiceEntry
 
 	log := handle.log
 
+	// create an intermediary channel for logging discoveries and handling the case when there is no reader
+	entries := make(chan *zeroconf.ServiceEntry)
+
 	resolver, err := zeroconf.NewResolver(nil)
 	if err != nil {
 		log.WithError(err).Error("Initializing discovery failed.")
+		close(entries)
+		return entries
 	}
 
 	log.Debug("Initialized discovery.")
 
-	// create an intermediary channel for logging discoveries and handling the case when there is no reader
-	entries := make(chan *zeroconf.ServiceEntry)
-
 	err = resolver.Browse(ctx, "_sensoControl._tcp", "local.", entries)
 	if err != nil {
 		log.WithError(err).Error("Browsing failed.")
@@ -29,3 +34,73 @@ func (handle *Handle) Discover(ctx context.Context) chan *zeroconf.ServiceEntry
 	return entries
 
 }
+
+// resolveSerial discovers the address of the Senso with the given serial
+func (handle *Handle) resolveSerial(ctx context.Context, serial string) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	entries := handle.Discover(ctx)
+	// Keep reading after returning, until browsing has stopped
+	defer func() {
+		go func() {
+			for range entries {
+			}
+		}()
+	}()
+
+	for entry := range entries {
+		address := entryAddress(entry)
+		if entrySerial(entry) == serial && address != "" {
+			return address, nil
+		}
+	}
+
+	if ctx.Err() == context.Canceled {
+		return "", ctx.Err()
+	}
+	return "", fmt.Errorf("Could not find Senso %s.", serial)
+}
+
+// discoverSingle discovers Sensos until ctx is done, returning serial and address if exactly one was found
+func (handle *Handle) discoverSingle(ctx context.Context) (string, string, error) {
+	devices := make(map[string]string)
+	for entry := range handle.Discover(ctx) {
+		address := entryAddress(entry)
+		if address != "" {
+			devices[entrySerial(entry)] = address
+		}
+	}
+
+	if len(devices) == 0 {
+		return "", "", errors.New("No Sensos discovered.")
+	} else if len(devices) > 1 {
+		return "", "", fmt.Errorf("Discovered multiple Sensos: %v.", devices)
+	}
+
+	for serial, address := range devices {
+		return serial, address, nil
+	}
+	return "", "", nil
+}
+
+// entrySerial returns the serial number advertised in the TXT record of a discovered Senso
+func entrySerial(entry *zeroconf.ServiceEntry) string {
+	for _, txt := range entry.Text {
+		if strings.HasPrefix(txt, "ser_no=") {
+			// Senso firmware up to 3.8.0 adds garbage at end of serial in mDNS entries
+			return strings.Split(strings.TrimPrefix(txt, "ser_no="), "\\000")[0]
+		}
+	}
+	return ""
+}
+
+// entryAddress returns the first usable IPv4 address of a discovered Senso
+func entryAddress(entry *zeroconf.ServiceEntry) string {
+	for _, ip := range entry.AddrIPv4 {
+		if !ip.IsUnspecified() {
+			return ip.String()
+		}
+	}
+	return ""
+}
@@ -7,11 +7,16 @@ import (
 
 	"github.com/cskr/pubsub"
 	"github.com/sirupsen/logrus"
+
+	"github.com/dividat/driver/src/dividat-driver/recording"
+	"github.com/dividat/driver/src/dividat-driver/senso/protocol"
 )
 
 // Handle for managing Senso
 type Handle struct {
 	broker *pubsub.PubSub
+	// Held while using the broker, so that it is only shut down once nothing uses it anymore
+	brokerMutex *sync.RWMutex
 
 	Address *string
 
@@ -20,26 +25,101 @@ type Handle struct {
 	cancelCurrentConnection context.CancelFunc
 	connectionChangeMutex   *sync.Mutex
 
+	device      *Device
+	deviceMutex *sync.RWMutex
+
+	// Describe the current connection, guarded by connectionMutex
+	connectionId       int
+	channels           map[string]ConnectionState
+	pinnedSerial       string
+	connectionFailures int
+	resolvingSerial    bool
+	connectionMutex    *sync.Mutex
+
+	// Sensos seen on the network by serial, guarded by registryMutex
+	registry      map[string]*DiscoveredDevice
+	registryMutex *sync.Mutex
+
+	// Records packets sent and received
+	recorder *recording.Recorder
+
+	// Commands waiting to be written to the control channel
+	commandQueue chan *queuedWrite
+
+	// Commands waiting for a response, guarded by pendingMutex
+	pending      []*pendingCommand
+	pendingMutex *sync.Mutex
+
+	// Serial of a named connection, empty for the default connection
+	name string
+
+	// Named connections by serial, guarded by namedMutex. Only used by the default connection.
+	named      map[string]*namedHandle
+	namedMutex *sync.Mutex
+
+	config Config
+
 	log *logrus.Entry
 }
 
 // New returns an initialized Senso handler
-func New(ctx context.Context, log *logrus.Entry) *Handle {
+func New(ctx context.Context, log *logrus.Entry, config Config) *Handle {
+	if config.StatePath == "" {
+		config.StatePath = DefaultStatePath()
+	}
+
+	handle := newHandle(ctx, log, config, make(map[string]*DiscoveredDevice), &sync.Mutex{})
+
+	handle.named = make(map[string]*namedHandle)
+	handle.namedMutex = &sync.Mutex{}
+
+	// Keep track of Sensos on the network
+	go handle.runRegistry()
+
+	if handle.config.AutoConnect {
+		go handle.autoConnect()
+	}
+
+	return handle
+}
+
+// newHandle returns a handle without any connection, sharing the given registry
+func newHandle(ctx context.Context, log *logrus.Entry, config Config, registry map[string]*DiscoveredDevice, registryMutex *sync.Mutex) *Handle {
 	handle := Handle{}
 
 	handle.ctx = ctx
 
 	handle.log = log
 
+	handle.config = config
+
 	handle.connectionChangeMutex = &sync.Mutex{}
+	handle.deviceMutex = &sync.RWMutex{}
+	handle.connectionMutex = &sync.Mutex{}
+	handle.pendingMutex = &sync.Mutex{}
+
+	handle.commandQueue = make(chan *queuedWrite, commandQueueSize)
+
+	handle.recorder = recording.NewRecorder(ctx, log, config.Recording, "senso", handle.describeRecording)
+
+	handle.registry = registry
+	handle.registryMutex = registryMutex
+
+	handle.channels = map[string]ConnectionState{
+		ChannelData:    ConnectionState{State: StateIdle},
+		ChannelControl: ConnectionState{State: StateIdle},
+	}
 
 	// PubSub broker
 	handle.broker = pubsub.New(32)
+	handle.brokerMutex = &sync.RWMutex{}
 
-	// Clean up
+	// Clean up, once nothing is being published anymore
 	go func() {
 		<-ctx.Done()
+		handle.brokerMutex.Lock()
 		handle.broker.Shutdown()
+		handle.brokerMutex.Unlock()
 	}()
 
 	return &handle
@@ -47,38 +127,228 @@ func New(ctx context.Context, log *logrus.Entry) *Handle {
 
 // Connect to a Senso, will create TCP connections to control and data ports
 func (handle *Handle) Connect(address string) {
+	handle.connect(address, "")
+}
+
+// ConnectSerial connects to the Senso with the given serial, wherever it can be found on the network.
+//
+// The address is looked up in the registry of discovered Sensos or resolved via
+// mDNS, until the Senso is found or the connection is changed. The connection is
+// pinned to the serial, following the Senso when its address changes.
+func (handle *Handle) ConnectSerial(serial string) {
+	handle.connectionChangeMutex.Lock()
+	defer handle.connectionChangeMutex.Unlock()
+
+	handle.Disconnect()
+	handle.setDevice(nil)
+
+	// Resolving is cancelled like a connection
+	ctx, cancel := context.WithCancel(handle.ctx)
+	handle.cancelCurrentConnection = cancel
+
+	handle.connectionMutex.Lock()
+	handle.connectionId++
+	connectionId := handle.connectionId
+	handle.pinnedSerial = serial
+	handle.connectionFailures = 0
+	handle.connectionMutex.Unlock()
+
+	handle.log.WithField("serial", serial).Info("Attempting to connect with Senso by serial.")
+	go handle.resolveAndConnect(ctx, connectionId, serial)
+}
+
+// connect to a Senso at address. If a serial is given, the connection is pinned to the Senso with that serial and follows it when its address changes.
+func (handle *Handle) connect(address string, serial string) {
 
 	// Only allow one connection change at a time
 	handle.connectionChangeMutex.Lock()
 	defer handle.connectionChangeMutex.Unlock()
 
+	handle.connectLocked(address, serial)
+}
+
+// connectLocked does the work of connect, the caller must hold connectionChangeMutex
+func (handle *Handle) connectLocked(address string, serial string) {
+
 	// disconnect current connection first
 	handle.Disconnect()
 
 	// set address in handle
 	handle.Address = &address
+	handle.setDevice(nil)
 
 	// Create a child context for a new connection. This allows an individual connection (attempt) to be cancelled without restarting the whole Senso handler
 	ctx, cancel := context.WithCancel(handle.ctx)
 
-	handle.log.WithField("address", address).Info("Attempting to connect with Senso.")
+	handle.log.WithField("address", address).WithField("serial", serial).Info("Attempting to connect with Senso.")
 
-	onReceive := func(data []byte) {
-		handle.broker.TryPub(data, "rx")
+	// Identify this connection, so that state changes of previous connections can be ignored
+	handle.connectionMutex.Lock()
+	handle.connectionId++
+	connectionId := handle.connectionId
+	handle.pinnedSerial = serial
+	handle.connectionFailures = 0
+	handle.connectionMutex.Unlock()
+
+	onStateChange := func(channel string, onConnect func()) func(ConnectionState) {
+		return func(state ConnectionState) {
+			handle.setChannelState(connectionId, channel, state)
+			if state.State == StateConnected {
+				onConnect()
+			}
+			if channel == ChannelControl {
+				handle.trackPinnedConnection(connectionId, address, state)
+			}
+		}
+	}
+
+	// Every channel needs its own decoder, as packets are framed per TCP stream
+	receiver := func(log *logrus.Entry, decoder *protocol.Decoder) onReceive {
+		return func(data []byte) {
+			handle.recorder.Record(recording.DirectionRx, data)
+			handle.publish(data, "rx")
+			handle.decode(log, decoder, data)
+		}
 	}
 
-	go connectTCP(ctx, handle.log.WithField("channel", "data"), address+":55568", handle.broker.Sub("noTx"), onReceive)
+	dataLog := handle.log.WithField("channel", ChannelData)
+	dataDecoder := protocol.NewDecoder()
+	controlLog := handle.log.WithField("channel", ChannelControl)
+	controlDecoder := protocol.NewDecoder()
+	onControlConnect := func() {
+		controlDecoder.Reset()
+		handle.queryDevice()
+	}
+
+	if recording.IsReplayURL(address) {
+		handle.connectReplay(ctx, address, receiver(dataLog, dataDecoder), onStateChange(ChannelData, dataDecoder.Reset), receiver(controlLog, controlDecoder), onStateChange(ChannelControl, onControlConnect))
+		handle.cancelCurrentConnection = cancel
+		return
+	}
+
+	go connectTCP(ctx, dataLog, address+":55568", handle.subConnection(ctx, "noTx"), nil, receiver(dataLog, dataDecoder), onStateChange(ChannelData, dataDecoder.Reset))
+
 	time.Sleep(1000 * time.Millisecond)
-	go connectTCP(ctx, handle.log.WithField("channel", "control"), address+":55567", handle.broker.Sub("tx"), onReceive)
+
+	go connectTCP(ctx, controlLog, address+":55567", handle.subConnection(ctx, "tx"), handle.commandQueue, receiver(controlLog, controlDecoder), onStateChange(ChannelControl, onControlConnect))
 
 	handle.cancelCurrentConnection = cancel
 }
 
+// subConnection subscribes to topics for the lifetime of a connection, unsubscribing once ctx is done
+func (handle *Handle) subConnection(ctx context.Context, topics ...string) chan interface{} {
+	ch := handle.broker.Sub(topics...)
+	go func() {
+		<-ctx.Done()
+		// The broker stops handling requests once it has been shut down
+		handle.brokerMutex.RLock()
+		defer handle.brokerMutex.RUnlock()
+		if handle.ctx.Err() == nil {
+			handle.broker.Unsub(ch)
+		}
+	}()
+	return ch
+}
+
 // Disconnect from current connection
 func (handle *Handle) Disconnect() {
 	if handle.cancelCurrentConnection != nil {
 		handle.log.Info("Disconnecting from Senso.")
 		handle.cancelCurrentConnection()
 		handle.Address = nil
+		handle.setDevice(nil)
+
+		handle.connectionMutex.Lock()
+		handle.pinnedSerial = ""
+		handle.connectionMutex.Unlock()
 	}
 }
+
+// shutdown ends the current connection and cancels the context of the handle with cancel, the handle must not be used afterwards
+func (handle *Handle) shutdown(cancel context.CancelFunc) {
+	handle.connectionChangeMutex.Lock()
+	handle.Disconnect()
+	handle.connectionChangeMutex.Unlock()
+
+	cancel()
+}
+
+// publish msg on topics, unless the broker has been shut down
+func (handle *Handle) publish(msg interface{}, topics ...string) {
+	handle.brokerMutex.RLock()
+	defer handle.brokerMutex.RUnlock()
+	if handle.ctx.Err() == nil {
+		handle.broker.TryPub(msg, topics...)
+	}
+}
+
+// transmit data on the control channel, if it can be written immediately
+func (handle *Handle) transmit(data []byte) {
+	handle.recorder.Record(recording.DirectionTx, data)
+	handle.publish(data, "tx")
+}
+
+// describeRecording adds information about the connected Senso to the metadata of a recording
+func (handle *Handle) describeRecording(metadata *recording.Metadata) {
+	if device := handle.GetDevice(); device != nil && device.DevInfo != nil {
+		metadata.Serial = device.DevInfo.Controller.SerialNumber
+		metadata.Firmware = device.DevInfo.Controller.SoftwareVersion.String()
+		return
+	}
+
+	// Fall back to the serial the connection is pinned to
+	handle.connectionMutex.Lock()
+	metadata.Serial = handle.pinnedSerial
+	handle.connectionMutex.Unlock()
+}
+
+// decode packets from received data and publish them as messages
+func (handle *Handle) decode(log *logrus.Entry, decoder *protocol.Decoder, data []byte) {
+	decoder.Write(data)
+
+	for {
+		packet, err := decoder.Next()
+		if err != nil {
+			log.WithError(err).Debug("Could not decode data from Senso.")
+			continue
+		} else if packet == nil {
+			return
+		}
+
+		for _, block := range packet.Blocks {
+			if block.IsResponse() {
+				handle.resolvePending(block)
+			}
+			message := blockMessage(log, block)
+			if message.Response != nil {
+				handle.updateDevice(message.Response.Payload)
+			}
+			handle.publish(message, "rx-decoded")
+		}
+	}
+}
+
+// blockMessage converts a received block into a message
+func blockMessage(log *logrus.Entry, block protocol.Block) Message {
+	var message Message
+
+	payload, err := block.Decode()
+	if err != nil {
+		if err != protocol.ErrUnknownBlockType {
+			log.WithError(err).WithField("blockType", block.Type).Debug("Could not decode block.")
+		}
+		payload = nil
+	}
+
+	if measurement, ok := payload.(*protocol.Measurement); ok && !block.IsResponse() {
+		message.Measurement = measurement
+	} else {
+		message.Response = &Response{
+			BlockType: block.Type,
+			Payload:   payload,
+			Data:      block.Data,
+		}
+	}
+
+	return message
+}
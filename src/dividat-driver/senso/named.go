@@ -0,0 +1,127 @@
+package senso
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Path segments below /senso that do not name a connection
+var reservedSegments = map[string]bool{
+	"device":  true,
+	"devices": true,
+	"record":  true,
+}
+
+// Format of Senso serials, like 31-00000000
+var serialPattern = regexp.MustCompile(`^[0-9]{2}-[0-9]{8}$`)
+
+// namedHandle is a named connection and the number of WebSocket clients using it
+type namedHandle struct {
+	*Handle
+	cancel  context.CancelFunc
+	clients int
+}
+
+// acquireNamed returns the connection named by serial, creating and connecting it if it does not exist yet.
+//
+// Every call must be followed by a call to releaseNamed once the client is done with the connection.
+func (handle *Handle) acquireNamed(serial string) *Handle {
+	handle.namedMutex.Lock()
+	defer handle.namedMutex.Unlock()
+
+	if named, ok := handle.named[serial]; ok {
+		named.clients++
+		return named.Handle
+	}
+
+	config := handle.config
+	// Only the default connection auto-connects and remembers the connected Senso
+	config.AutoConnect = false
+
+	ctx, cancel := context.WithCancel(handle.ctx)
+	named := &namedHandle{
+		Handle:  newHandle(ctx, handle.log.WithField("connection", serial), config, handle.registry, handle.registryMutex),
+		cancel:  cancel,
+		clients: 1,
+	}
+	named.name = serial
+	handle.named[serial] = named
+
+	handle.log.WithField("serial", serial).Info("Created named Senso connection.")
+	named.ConnectSerial(serial)
+
+	return named.Handle
+}
+
+// releaseNamed removes a client from the connection named by serial, closing the connection when no clients are left
+func (handle *Handle) releaseNamed(serial string) {
+	handle.namedMutex.Lock()
+	defer handle.namedMutex.Unlock()
+
+	named, ok := handle.named[serial]
+	if !ok {
+		return
+	}
+	named.clients--
+	if named.clients > 0 {
+		return
+	}
+
+	delete(handle.named, serial)
+	named.shutdown(named.cancel)
+	handle.log.WithField("serial", serial).Info("Closed named Senso connection.")
+}
+
+// isSerial returns true if name looks like a serial or is the serial of a Senso seen on the network
+func (handle *Handle) isSerial(name string) bool {
+	if serialPattern.MatchString(name) {
+		return true
+	}
+	handle.registryMutex.Lock()
+	defer handle.registryMutex.Unlock()
+	_, known := handle.registry[name]
+	return known
+}
+
+// serveNamed routes requests below /senso/{serial} to the named connection.
+//
+// Returns false if the path does not name a connection.
+func (handle *Handle) serveNamed(w http.ResponseWriter, r *http.Request) bool {
+	segments := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/senso/"), "/", 2)
+	serial := segments[0]
+	if serial == "" || reservedSegments[serial] {
+		return false
+	}
+
+	resource := ""
+	if len(segments) == 2 {
+		resource = segments[1]
+	}
+
+	if resource == "" && websocket.IsWebSocketUpgrade(r) && handle.isSerial(serial) {
+		// Only create connections for clients that will use them, as long as they use them
+		handle.acquireNamed(serial).streamData(w, r, func() { handle.releaseNamed(serial) })
+		return true
+	}
+
+	handle.namedMutex.Lock()
+	named, ok := handle.named[serial]
+	handle.namedMutex.Unlock()
+	if !ok {
+		return false
+	}
+
+	if r.Method == "GET" && resource == "device" {
+		named.ServeDevice(w, r)
+		return true
+	} else if resource == "record" || strings.HasPrefix(resource, "record/") {
+		named.recorder.Serve(w, r, strings.TrimPrefix(resource, "record"))
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Upper bound for the length of a single block. Longer blocks are considered malformed.
+const maxBlockLength = 4096
+
+// FramingError is returned by the decoder when it encounters data that can not be the start of a packet
+type FramingError struct {
+	Reason string
+}
+
+func (err *FramingError) Error() string {
+	return "malformed packet: " + err.Reason
+}
+
+// Decoder reassembles packets from a byte stream.
+//
+// A TCP read may contain a fraction of a packet or several packets at once, the
+// decoder buffers data until complete packets are available.
+type Decoder struct {
+	buffer []byte
+}
+
+// NewDecoder returns a decoder with an empty buffer
+func NewDecoder() *Decoder {
+	return &Decoder{}
+}
+
+// Write appends a chunk of the stream to the buffer. The chunk is copied, so the caller may reuse it.
+func (decoder *Decoder) Write(chunk []byte) (int, error) {
+	decoder.buffer = append(decoder.buffer, chunk...)
+	return len(chunk), nil
+}
+
+// Buffered returns the number of bytes that have not been decoded yet
+func (decoder *Decoder) Buffered() int {
+	return len(decoder.buffer)
+}
+
+// Reset discards any buffered data, e.g. when the underlying connection is re-established
+func (decoder *Decoder) Reset() {
+	decoder.buffer = nil
+}
+
+// Next returns the next complete packet from the buffer.
+//
+// If no complete packet is buffered, nil is returned without an error. If the
+// buffer does not start with a valid packet, a *FramingError is returned and the
+// first byte is discarded, so that calling Next again will resynchronize with the
+// stream.
+func (decoder *Decoder) Next() (*Packet, error) {
+	if len(decoder.buffer) < HeaderLength {
+		return nil, nil
+	}
+
+	header := Header{
+		ProtocolVersion: decoder.buffer[0],
+		NumberOfBlocks:  decoder.buffer[1],
+	}
+
+	if header.ProtocolVersion > MaxProtocolVersion {
+		return nil, decoder.skip(fmt.Sprintf("unknown protocol version %d", header.ProtocolVersion))
+	}
+	for _, reserved := range decoder.buffer[2:HeaderLength] {
+		if reserved != 0 {
+			return nil, decoder.skip("reserved header bytes are not zero")
+		}
+	}
+
+	numberOfBlocks := int(header.NumberOfBlocks)
+	if header.ProtocolVersion == 0 && numberOfBlocks == 0 {
+		numberOfBlocks = 1
+	}
+
+	offset := HeaderLength
+	blocks := make([]Block, 0, numberOfBlocks)
+	for i := 0; i < numberOfBlocks; i++ {
+		if len(decoder.buffer) < offset+BlockHeaderLength {
+			return nil, nil
+		}
+
+		length := int(binary.LittleEndian.Uint16(decoder.buffer[offset:]))
+		blockType := binary.LittleEndian.Uint16(decoder.buffer[offset+2:])
+
+		if length > maxBlockLength {
+			return nil, decoder.skip(fmt.Sprintf("block length %d exceeds maximum", length))
+		}
+		if header.ProtocolVersion == 0 && blockType == BlockTypeMeasurement && length == measurementLength+1 {
+			length = measurementLength
+		}
+
+		offset += BlockHeaderLength
+		if len(decoder.buffer) < offset+length {
+			return nil, nil
+		}
+
+		data := make([]byte, length)
+		copy(data, decoder.buffer[offset:offset+length])
+		blocks = append(blocks, Block{Type: blockType, Data: data})
+
+		offset += length
+	}
+
+	decoder.consume(offset)
+
+	return &Packet{Header: header, Blocks: blocks}, nil
+}
+
+func (decoder *Decoder) consume(n int) {
+	decoder.buffer = append(decoder.buffer[:0], decoder.buffer[n:]...)
+}
+
+func (decoder *Decoder) skip(reason string) error {
+	decoder.consume(1)
+	return &FramingError{Reason: reason}
+}
@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func measurementData(timestamp uint32) []byte {
+	data := make([]byte, measurementLength)
+	binary.LittleEndian.PutUint32(data, timestamp)
+	for i := 4; i < len(data); i++ {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+func concat(chunks ...[]byte) []byte {
+	var data []byte
+	for _, chunk := range chunks {
+		data = append(data, chunk...)
+	}
+	return data
+}
+
+func TestDecoderNext(t *testing.T) {
+	measurement := &Packet{
+		Header: Header{ProtocolVersion: 1, NumberOfBlocks: 1},
+		Blocks: []Block{Block{Type: BlockTypeMeasurement, Data: measurementData(1)}},
+	}
+	encoded := measurement.Encode()
+
+	devInfo := NewRequest(BlockTypeDevInfo, []byte{})
+	encodedDevInfo := devInfo.Encode()
+
+	// Version 0 firmware states a length one byte longer than the measurement it sends
+	v0Measurement := &Packet{
+		Header: Header{ProtocolVersion: 0, NumberOfBlocks: 0},
+		Blocks: []Block{Block{Type: BlockTypeMeasurement, Data: measurementData(2)}},
+	}
+	encodedV0 := v0Measurement.Encode()
+	binary.LittleEndian.PutUint16(encodedV0[HeaderLength:], measurementLength+1)
+
+	tests := []struct {
+		name          string
+		chunks        [][]byte
+		packets       []*Packet
+		framingErrors int
+		buffered      int
+	}{
+		{
+			name:    "complete packet",
+			chunks:  [][]byte{encoded},
+			packets: []*Packet{measurement},
+		},
+		{
+			name:    "packet split across writes",
+			chunks:  [][]byte{encoded[:3], encoded[3:10], encoded[10:]},
+			packets: []*Packet{measurement},
+		},
+		{
+			name:    "several packets in one write",
+			chunks:  [][]byte{concat(encoded, encodedDevInfo, encoded)},
+			packets: []*Packet{measurement, devInfo, measurement},
+		},
+		{
+			name:     "incomplete packet",
+			chunks:   [][]byte{encoded[:len(encoded)-1]},
+			buffered: len(encoded) - 1,
+		},
+		{
+			name:          "garbage before a header",
+			chunks:        [][]byte{concat([]byte{0xFF, 0x42, 0x00}, encoded)},
+			packets:       []*Packet{measurement},
+			framingErrors: 3,
+		},
+		{
+			name:          "garbage split from header",
+			chunks:        [][]byte{[]byte{0x01, 0x01, 0x07}, encoded[:5], encoded[5:]},
+			packets:       []*Packet{measurement},
+			framingErrors: 3,
+		},
+		{
+			name:    "v0 measurement with length + 1",
+			chunks:  [][]byte{concat(encodedV0, encoded)},
+			packets: []*Packet{v0Measurement, measurement},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoder := NewDecoder()
+			var packets []*Packet
+			framingErrors := 0
+
+			for _, chunk := range test.chunks {
+				decoder.Write(chunk)
+				for {
+					packet, err := decoder.Next()
+					if _, ok := err.(*FramingError); ok {
+						framingErrors++
+						continue
+					} else if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					} else if packet == nil {
+						break
+					}
+					packets = append(packets, packet)
+				}
+			}
+
+			if !reflect.DeepEqual(packets, test.packets) {
+				t.Errorf("decoded %v, expected %v", packets, test.packets)
+			}
+			if framingErrors != test.framingErrors {
+				t.Errorf("got %d framing errors, expected %d", framingErrors, test.framingErrors)
+			}
+			if decoder.Buffered() != test.buffered {
+				t.Errorf("%d bytes buffered, expected %d", decoder.Buffered(), test.buffered)
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package protocol
+
+/* Encoding and decoding of the binary protocol spoken by Senso.
+
+Senso sends and receives packets over its data (55568) and control (55567) TCP
+channels. Every packet starts with an 8 byte header:
+
+    | protocol version (1) | number of blocks (1) | reserved (6) |
+
+followed by the announced number of blocks, each consisting of:
+
+    | length (2, LE) | type (2, LE) | data (length) |
+
+Responses to requests sent on the control channel carry the type of the
+request with bit 15 set (type | 0x8000).
+
+Firmware speaking protocol version 0 leaves the number of blocks at zero and
+announces measurement blocks one byte longer than they actually are. Both
+quirks are accounted for when decoding.
+
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// HeaderLength is the length of the packet header in bytes
+const HeaderLength = 8
+
+// BlockHeaderLength is the length of the length and type fields preceding block data
+const BlockHeaderLength = 4
+
+// MaxProtocolVersion is the highest protocol version understood by the decoder
+const MaxProtocolVersion = 1
+
+// Block types
+const (
+	BlockTypeMeasurement uint16 = 0x0080
+	BlockTypeDevInfo     uint16 = 0x00D1
+	BlockTypeVccInfo     uint16 = 0x00D2
+	BlockTypeDfu         uint16 = 0x00F0
+)
+
+// DfuMagicKey must be sent (big endian) as data of a DFU block for Senso to reboot into its bootloader
+const DfuMagicKey uint64 = 0xFA173CCD87664FBE
+
+// ResponseFlag is set on the type of blocks sent in response to a request
+const ResponseFlag uint16 = 0x8000
+
+// NumberOfPlates is the number of plates (and LED boards) of a Senso.
+//
+// Values that are reported per plate or per LED board are ordered as center,
+// up, right, down, left.
+const NumberOfPlates = 5
+
+// SensorsPerPlate is the number of force sensors in every plate
+const SensorsPerPlate = 4
+
+// ErrUnknownBlockType is returned when decoding a block of a type that has no known payload
+var ErrUnknownBlockType = errors.New("unknown block type")
+
+// Header of a packet
+type Header struct {
+	ProtocolVersion uint8
+	NumberOfBlocks  uint8
+}
+
+// Block of data within a packet
+type Block struct {
+	Type uint16
+	Data []byte
+}
+
+// Packet consisting of a header and one or more blocks
+type Packet struct {
+	Header Header
+	Blocks []Block
+}
+
+// NewRequest returns a packet with a single block of the given type, ready to be sent on the control channel.
+//
+// Requests use protocol version 0, like the DFU command, which is understood by all firmware versions.
+func NewRequest(blockType uint16, data []byte) *Packet {
+	return &Packet{
+		Header: Header{ProtocolVersion: 0, NumberOfBlocks: 1},
+		Blocks: []Block{Block{Type: blockType, Data: data}},
+	}
+}
+
+// IsResponse returns true if the block was sent in response to a request
+func (block *Block) IsResponse() bool {
+	return block.Type&ResponseFlag != 0
+}
+
+// RequestType returns the type with the response flag cleared
+func (block *Block) RequestType() uint16 {
+	return block.Type &^ ResponseFlag
+}
+
+// Decode the data of the block into a typed payload (*Measurement, *DevInfo or *VccInfo).
+//
+// ErrUnknownBlockType is returned for blocks without a known payload.
+func (block *Block) Decode() (interface{}, error) {
+	switch block.RequestType() {
+	case BlockTypeMeasurement:
+		return DecodeMeasurement(block.Data)
+	case BlockTypeDevInfo:
+		return DecodeDevInfo(block.Data)
+	case BlockTypeVccInfo:
+		return DecodeVccInfo(block.Data)
+	default:
+		return nil, ErrUnknownBlockType
+	}
+}
+
+// Encode the packet into its binary representation
+func (packet *Packet) Encode() []byte {
+	var buffer bytes.Buffer
+
+	header := make([]byte, HeaderLength)
+	header[0] = packet.Header.ProtocolVersion
+	header[1] = packet.Header.NumberOfBlocks
+	buffer.Write(header)
+
+	for _, block := range packet.Blocks {
+		blockHeader := make([]byte, BlockHeaderLength)
+		binary.LittleEndian.PutUint16(blockHeader[0:], uint16(len(block.Data)))
+		binary.LittleEndian.PutUint16(blockHeader[2:], block.Type)
+		buffer.Write(blockHeader)
+		buffer.Write(block.Data)
+	}
+
+	return buffer.Bytes()
+}
+
+// Decode a single complete packet
+func Decode(data []byte) (*Packet, error) {
+	decoder := NewDecoder()
+	decoder.Write(data)
+
+	packet, err := decoder.Next()
+	if err != nil {
+		return nil, err
+	} else if packet == nil {
+		return nil, errors.New("incomplete packet")
+	} else if decoder.Buffered() > 0 {
+		return nil, fmt.Errorf("%d trailing bytes after packet", decoder.Buffered())
+	}
+
+	return packet, nil
+}
+
+// MEASUREMENT
+
+// measurementLength is the length of a measurement block: a 4 byte timestamp and 16 bit readings of all sensors
+const measurementLength = 4 + NumberOfPlates*SensorsPerPlate*2
+
+// Plate holds the readings of the force sensors of a plate
+type Plate [SensorsPerPlate]int16
+
+// Measurement sent periodically on the data channel
+type Measurement struct {
+	// Milliseconds since the device was started
+	Timestamp uint32 `json:"timestamp"`
+
+	Plates [NumberOfPlates]Plate `json:"plates"`
+}
+
+// DecodeMeasurement decodes the data of a measurement block
+func DecodeMeasurement(data []byte) (*Measurement, error) {
+	if len(data) != measurementLength {
+		return nil, fmt.Errorf("measurement has length %d, expected %d", len(data), measurementLength)
+	}
+
+	measurement := Measurement{
+		Timestamp: binary.LittleEndian.Uint32(data[0:]),
+	}
+
+	offset := 4
+	for plate := 0; plate < NumberOfPlates; plate++ {
+		for sensor := 0; sensor < SensorsPerPlate; sensor++ {
+			measurement.Plates[plate][sensor] = int16(binary.LittleEndian.Uint16(data[offset:]))
+			offset += 2
+		}
+	}
+
+	return &measurement, nil
+}
+
+// DEV_INFO
+
+const devInfoItemLength = 32
+
+// Version of software running on a board
+type Version struct {
+	Major   uint8 `json:"major"`
+	Minor   uint8 `json:"minor"`
+	Feature uint8 `json:"feature"`
+	Fix     uint8 `json:"fix"`
+}
+
+func (version Version) String() string {
+	return fmt.Sprintf("%d.%d.%d.%d", version.Major, version.Minor, version.Feature, version.Fix)
+}
+
+// DevInfoItem describes a single board
+type DevInfoItem struct {
+	StatusCode      uint32  `json:"statusCode"`
+	ErrorCode       uint32  `json:"errorCode"`
+	SoftwareVersion Version `json:"softwareVersion"`
+	HardwareVersion uint32  `json:"hardwareVersion"`
+	SerialNumber    string  `json:"serialNumber"`
+}
+
+// DevInfo is sent in response to a GET_DEV_INFO request
+type DevInfo struct {
+	// The controller item holds the serial number of the device, not of the controller board.
+	Controller DevInfoItem   `json:"controller"`
+	LedBoards  []DevInfoItem `json:"ledBoards"`
+}
+
+// DecodeDevInfo decodes the data of a DEV_INFO response
+func DecodeDevInfo(data []byte) (*DevInfo, error) {
+	if len(data) == 0 || len(data)%devInfoItemLength != 0 {
+		return nil, fmt.Errorf("DEV_INFO has length %d, expected a multiple of %d", len(data), devInfoItemLength)
+	}
+
+	var items []DevInfoItem
+	for offset := 0; offset < len(data); offset += devInfoItemLength {
+		item := data[offset : offset+devInfoItemLength]
+		items = append(items, DevInfoItem{
+			StatusCode: binary.LittleEndian.Uint32(item[0:]),
+			ErrorCode:  binary.LittleEndian.Uint32(item[4:]),
+			SoftwareVersion: Version{
+				Major:   item[11],
+				Minor:   item[10],
+				Feature: item[9],
+				Fix:     item[8],
+			},
+			HardwareVersion: binary.LittleEndian.Uint32(item[12:]),
+			SerialNumber:    string(bytes.SplitN(item[16:32], []byte{0}, 2)[0]),
+		})
+	}
+
+	return &DevInfo{
+		Controller: items[0],
+		LedBoards:  items[1:],
+	}, nil
+}
+
+// Encode the items into the data of a DEV_INFO response
+func (devInfo *DevInfo) Encode() []byte {
+	items := append([]DevInfoItem{devInfo.Controller}, devInfo.LedBoards...)
+	data := make([]byte, len(items)*devInfoItemLength)
+
+	for ix, item := range items {
+		encoded := data[ix*devInfoItemLength:]
+		binary.LittleEndian.PutUint32(encoded[0:], item.StatusCode)
+		binary.LittleEndian.PutUint32(encoded[4:], item.ErrorCode)
+		encoded[8] = item.SoftwareVersion.Fix
+		encoded[9] = item.SoftwareVersion.Feature
+		encoded[10] = item.SoftwareVersion.Minor
+		encoded[11] = item.SoftwareVersion.Major
+		binary.LittleEndian.PutUint32(encoded[12:], item.HardwareVersion)
+		copy(encoded[16:32], item.SerialNumber)
+	}
+
+	return data
+}
+
+// VCC_INFO
+
+const vccInfoItemLength = 12
+
+// VccInfoItem holds supply voltages (in mV) and temperature (in 0.1 °C) of a single board
+type VccInfoItem struct {
+	Vcc3V3      uint16 `json:"vcc3V3"`
+	Vcc5V       uint16 `json:"vcc5V"`
+	Vcc12VMotor uint16 `json:"vcc12VMotor"`
+	Vcc12VLed   uint16 `json:"vcc12VLed"`
+	Vcc19VLed   uint16 `json:"vcc19VLed"`
+	Temperature int16  `json:"temperature"`
+}
+
+// VccInfo is sent in response to a GET_VCC_INFO request
+type VccInfo struct {
+	Controller VccInfoItem   `json:"controller"`
+	LedBoards  []VccInfoItem `json:"ledBoards"`
+}
+
+// DecodeVccInfo decodes the data of a VCC_INFO response
+func DecodeVccInfo(data []byte) (*VccInfo, error) {
+	if len(data) == 0 || len(data)%vccInfoItemLength != 0 {
+		return nil, fmt.Errorf("VCC_INFO has length %d, expected a multiple of %d", len(data), vccInfoItemLength)
+	}
+
+	var items []VccInfoItem
+	for offset := 0; offset < len(data); offset += vccInfoItemLength {
+		item := data[offset : offset+vccInfoItemLength]
+		items = append(items, VccInfoItem{
+			Vcc3V3:      binary.LittleEndian.Uint16(item[0:]),
+			Vcc5V:       binary.LittleEndian.Uint16(item[2:]),
+			Vcc12VMotor: binary.LittleEndian.Uint16(item[4:]),
+			Vcc12VLed:   binary.LittleEndian.Uint16(item[6:]),
+			Vcc19VLed:   binary.LittleEndian.Uint16(item[8:]),
+			Temperature: int16(binary.LittleEndian.Uint16(item[10:])),
+		})
+	}
+
+	return &VccInfo{
+		Controller: items[0],
+		LedBoards:  items[1:],
+	}, nil
+}
+
+// Encode the items into the data of a VCC_INFO response
+func (vccInfo *VccInfo) Encode() []byte {
+	items := append([]VccInfoItem{vccInfo.Controller}, vccInfo.LedBoards...)
+	data := make([]byte, len(items)*vccInfoItemLength)
+
+	for ix, item := range items {
+		encoded := data[ix*vccInfoItemLength:]
+		binary.LittleEndian.PutUint16(encoded[0:], item.Vcc3V3)
+		binary.LittleEndian.PutUint16(encoded[2:], item.Vcc5V)
+		binary.LittleEndian.PutUint16(encoded[4:], item.Vcc12VMotor)
+		binary.LittleEndian.PutUint16(encoded[6:], item.Vcc12VLed)
+		binary.LittleEndian.PutUint16(encoded[8:], item.Vcc19VLed)
+		binary.LittleEndian.PutUint16(encoded[10:], uint16(item.Temperature))
+	}
+
+	return data
+}
+
+// ParseVersion parses a version of the form major.minor.feature.fix, trailing components may be omitted
+func ParseVersion(version string) (Version, error) {
+	var components [4]uint8
+	parts := strings.Split(version, ".")
+	if len(parts) > len(components) {
+		return Version{}, fmt.Errorf("invalid version %q", version)
+	}
+	for ix, part := range parts {
+		component, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return Version{}, fmt.Errorf("invalid version %q: %v", version, err)
+		}
+		components[ix] = uint8(component)
+	}
+	return Version{Major: components[0], Minor: components[1], Feature: components[2], Fix: components[3]}, nil
+}
@@ -0,0 +1,141 @@
+package senso
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// How long every browse for Sensos lasts
+const registryBrowseDuration = 10 * time.Second
+
+// How long to wait between browses
+const registryBrowseInterval = 20 * time.Second
+
+// How long a Senso stays registered without being seen, unless its mDNS record expires earlier
+const registryTTL = 90 * time.Second
+
+// DiscoveredDevice is a Senso seen on the network
+type DiscoveredDevice struct {
+	Serial    string    `json:"serial"`
+	Addresses []string  `json:"addresses"`
+	Port      int       `json:"port"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// runRegistry keeps the registry of discovered Sensos up to date until the handle is done
+func (handle *Handle) runRegistry() {
+	for {
+		ctx, cancel := context.WithTimeout(handle.ctx, registryBrowseDuration)
+		for entry := range handle.Discover(ctx) {
+			handle.registerEntry(entry, time.Now())
+		}
+		cancel()
+
+		handle.expireDevices(time.Now())
+
+		select {
+		case <-handle.ctx.Done():
+			return
+		case <-time.After(registryBrowseInterval):
+		}
+	}
+}
+
+// registerEntry adds or refreshes the Senso of a discovered service entry
+func (handle *Handle) registerEntry(entry *zeroconf.ServiceEntry, now time.Time) {
+	serial := entrySerial(entry)
+	if serial == "" {
+		return
+	}
+
+	var addresses []string
+	for _, ip := range entry.AddrIPv4 {
+		if !ip.IsUnspecified() {
+			addresses = append(addresses, ip.String())
+		}
+	}
+
+	ttl := registryTTL
+	if recordTTL := time.Duration(entry.TTL) * time.Second; recordTTL < ttl {
+		ttl = recordTTL
+	}
+
+	handle.registryMutex.Lock()
+	device, known := handle.registry[serial]
+	if !known {
+		device = &DiscoveredDevice{Serial: serial, FirstSeen: now}
+		handle.registry[serial] = device
+	}
+	if len(addresses) > 0 {
+		device.Addresses = addresses
+	}
+	device.Port = entry.Port
+	device.LastSeen = now
+	device.ExpiresAt = now.Add(ttl)
+	appeared := *device
+	handle.registryMutex.Unlock()
+
+	if !known {
+		handle.log.WithField("serial", serial).WithField("addresses", addresses).Info("Senso appeared.")
+		handle.publish(Message{DeviceAppeared: &appeared}, "devices")
+	}
+}
+
+// expireDevices removes Sensos that have not been seen for too long
+func (handle *Handle) expireDevices(now time.Time) {
+	var disappeared []DiscoveredDevice
+
+	handle.registryMutex.Lock()
+	for serial, device := range handle.registry {
+		if !now.Before(device.ExpiresAt) {
+			disappeared = append(disappeared, *device)
+			delete(handle.registry, serial)
+		}
+	}
+	handle.registryMutex.Unlock()
+
+	for ix := range disappeared {
+		handle.log.WithField("serial", disappeared[ix].Serial).Info("Senso disappeared.")
+		handle.publish(Message{DeviceDisappeared: &disappeared[ix]}, "devices")
+	}
+}
+
+// registryAddress returns the address of a registered Senso, empty if the Senso is not registered
+func (handle *Handle) registryAddress(serial string) string {
+	handle.registryMutex.Lock()
+	defer handle.registryMutex.Unlock()
+
+	if device, ok := handle.registry[serial]; ok && len(device.Addresses) > 0 {
+		return device.Addresses[0]
+	}
+	return ""
+}
+
+// GetDevices returns the Sensos currently registered, ordered by serial
+func (handle *Handle) GetDevices() []DiscoveredDevice {
+	handle.registryMutex.Lock()
+	devices := make([]DiscoveredDevice, 0, len(handle.registry))
+	for _, device := range handle.registry {
+		devices = append(devices, *device)
+	}
+	handle.registryMutex.Unlock()
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Serial < devices[j].Serial
+	})
+	return devices
+}
+
+// ServeDevices responds with the Sensos currently registered
+func (handle *Handle) ServeDevices(w http.ResponseWriter, r *http.Request) {
+	devicesJson, _ := json.Marshal(handle.GetDevices())
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(devicesJson)
+}
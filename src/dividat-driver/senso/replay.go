@@ -0,0 +1,143 @@
+package senso
+
+/* Virtual Senso replaying a recording.
+
+Connecting to a replay URL (see the recording package) instead of an address
+replays the received packets of the recording as if they came from a Senso,
+through the same path as data from a real Senso. Both channels are reported as
+connected while the recording is replayed.
+
+Sent data is consumed by the control channel, which answers requests: DEV_INFO
+with the serial and firmware stated in the recording and no LED boards, other
+requests with a standard response. VCC_INFO is not answered, as voltages are not
+recorded.
+
+*/
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/dividat/driver/src/dividat-driver/recording"
+	"github.com/dividat/driver/src/dividat-driver/senso/protocol"
+)
+
+// connectReplay replays the recording at the replay URL address as the data channel and answers requests on the control channel
+func (handle *Handle) connectReplay(ctx context.Context, address string, dataReceive onReceive, onDataStateChange func(ConnectionState), controlReceive onReceive, onControlStateChange func(ConnectionState)) {
+	log := handle.log.WithField("address", address)
+
+	// Fail both channels if the recording can not be read. Clients may only replay stored recordings.
+	options, err := recording.ParseReplayURL(address)
+	if err == nil {
+		options.Path, err = recording.ResolveReplayPath(handle.config.Recording.Dir, options.Path)
+	}
+	var metadata *recording.Metadata
+	if err == nil {
+		metadata, err = recording.ReadMetadata(options.Path)
+	}
+	if err != nil {
+		log.WithError(err).Warning("Could not replay recording.")
+		onDataStateChange(ConnectionState{State: StateIdle, Address: address, Error: err.Error()})
+		onControlStateChange(ConnectionState{State: StateIdle, Address: address, Error: err.Error()})
+		return
+	}
+	if metadata == nil {
+		metadata = &recording.Metadata{}
+	}
+
+	go replayData(ctx, log.WithField("channel", ChannelData), address, options, dataReceive, onDataStateChange)
+	go replayControl(ctx, log.WithField("channel", ChannelControl), address, metadata, handle.subConnection(ctx, "tx"), handle.commandQueue, controlReceive, onControlStateChange)
+}
+
+// replayData replays the received packets of the recording, until the recording ends or ctx is cancelled
+func replayData(ctx context.Context, log *logrus.Entry, address string, options *recording.ReplayOptions, onReceive onReceive, onStateChange func(ConnectionState)) {
+	log.WithField("speed", options.Speed).WithField("loop", options.Loop).Info("Replaying recording.")
+	onStateChange(ConnectionState{State: StateConnected, Address: address})
+
+	state := ConnectionState{State: StateIdle, Address: address}
+	err := recording.Replay(ctx, options.Path, options.Speed, options.Loop, onReceive)
+	if ctx.Err() != nil {
+		log.Info("Replay stopped.")
+	} else if err != nil {
+		log.WithError(err).Warning("Could not replay recording.")
+		state.Error = err.Error()
+	} else {
+		log.Info("End of recording.")
+	}
+	onStateChange(state)
+}
+
+// replayControl consumes data sent to the virtual Senso and answers requests, until ctx is cancelled
+func replayControl(ctx context.Context, log *logrus.Entry, address string, metadata *recording.Metadata, tx chan interface{}, queue <-chan *queuedWrite, onReceive onReceive, onStateChange func(ConnectionState)) {
+	decoder := protocol.NewDecoder()
+	respond := func(data []byte) {
+		decoder.Write(data)
+		for {
+			packet, err := decoder.Next()
+			if err != nil {
+				log.WithError(err).Warning("Could not decode request.")
+				continue
+			} else if packet == nil {
+				return
+			}
+
+			for _, block := range packet.Blocks {
+				response := replayResponse(block, metadata)
+				if response != nil {
+					onReceive(response.Encode())
+				}
+			}
+		}
+	}
+
+	onStateChange(ConnectionState{State: StateConnected, Address: address})
+	defer onStateChange(ConnectionState{State: StateIdle, Address: address})
+
+	for {
+		select {
+
+		case <-ctx.Done():
+			return
+
+		case i, more := <-tx:
+			if !more {
+				return
+			}
+			data, _ := i.([]byte)
+			respond(data)
+
+		case queued := <-queue:
+			queued.done <- nil
+			respond(queued.data)
+		}
+	}
+}
+
+// replayResponse returns the response of the virtual Senso to a request, nil if it is not answered
+func replayResponse(request protocol.Block, metadata *recording.Metadata) *protocol.Packet {
+	var data []byte
+
+	switch request.Type {
+	case protocol.BlockTypeDevInfo:
+		// Firmware is unknown for converted recordings
+		firmware, _ := protocol.ParseVersion(metadata.Firmware)
+		devInfo := protocol.DevInfo{
+			Controller: protocol.DevInfoItem{
+				SoftwareVersion: firmware,
+				SerialNumber:    metadata.Serial,
+			},
+		}
+		data = devInfo.Encode()
+	case protocol.BlockTypeVccInfo:
+		return nil
+	default:
+		// Standard response, status and error code are zero
+		data = make([]byte, 12)
+	}
+
+	return &protocol.Packet{
+		Header: protocol.Header{ProtocolVersion: protocol.MaxProtocolVersion, NumberOfBlocks: 1},
+		Blocks: []protocol.Block{protocol.Block{Type: request.Type | protocol.ResponseFlag, Data: data}},
+	}
+}
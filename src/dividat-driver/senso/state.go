@@ -0,0 +1,71 @@
+package senso
+
+import (
+	"time"
+)
+
+// Connection states of a TCP channel to Senso
+const (
+	// Not connected and not attempting to connect
+	StateIdle = "Idle"
+	// Looking up the address of a Senso by its serial
+	StateResolving = "Resolving"
+	// Connection attempt in progress
+	StateDialing = "Dialing"
+	// Connection established
+	StateConnected = "Connected"
+	// Waiting for the next connection attempt
+	StateBackoff = "Backoff"
+	// Established connection was lost, will be re-dialed
+	StateFailed = "Failed"
+)
+
+// ConnectionState describes the state of a TCP channel to Senso
+type ConnectionState struct {
+	State   string `json:"state"`
+	Address string `json:"address,omitempty"`
+	// Time of the next connection attempt, set when backing off
+	NextRetry *time.Time `json:"nextRetry,omitempty"`
+	// Error causing a backoff or failure
+	Error string `json:"error,omitempty"`
+}
+
+// ChannelState is a message containing the state of a single channel
+type ChannelState struct {
+	Channel string
+	ConnectionState
+}
+
+// Names of the TCP channels to Senso
+const (
+	ChannelData    = "data"
+	ChannelControl = "control"
+)
+
+// setChannelState records the state of a channel and notifies subscribers.
+//
+// Changes reported by connections other than the current one are ignored, as
+// they may arrive after a new connection has been created.
+func (handle *Handle) setChannelState(connectionId int, channel string, state ConnectionState) {
+	handle.connectionMutex.Lock()
+	if connectionId != handle.connectionId {
+		handle.connectionMutex.Unlock()
+		return
+	}
+	handle.channels[channel] = state
+	handle.connectionMutex.Unlock()
+
+	handle.publish(Message{ConnectionStateChanged: &ChannelState{Channel: channel, ConnectionState: state}}, "state")
+}
+
+// GetChannelStates returns the current state of all channels
+func (handle *Handle) GetChannelStates() map[string]ConnectionState {
+	handle.connectionMutex.Lock()
+	defer handle.connectionMutex.Unlock()
+
+	channels := make(map[string]ConnectionState)
+	for channel, state := range handle.channels {
+		channels[channel] = state
+	}
+	return channels
+}
@@ -19,12 +19,24 @@ const maxInterval = 30 * time.Second
 
 type onReceive = func([]byte)
 
-// connectTCP creates a persistent tcp connection to address
-func connectTCP(ctx context.Context, baseLogger *logrus.Entry, address string, tx chan interface{}, onReceive onReceive) {
+// connectTCP creates a persistent tcp connection to address, reporting every change of the connection state. Data from tx is written as it comes, data from queue is written reliably.
+func connectTCP(ctx context.Context, baseLogger *logrus.Entry, address string, tx chan interface{}, queue <-chan *queuedWrite, onReceive onReceive, onStateChange func(ConnectionState)) {
 	var dialer net.Dialer
 
 	var log = baseLogger.WithField("address", address)
 
+	setState := func(state string, err error, nextRetry *time.Time) {
+		connectionState := ConnectionState{
+			State:     state,
+			Address:   address,
+			NextRetry: nextRetry,
+		}
+		if err != nil {
+			connectionState.Error = err.Error()
+		}
+		onStateChange(connectionState)
+	}
+
 	var conn net.Conn
 	dialTCP := func() error {
 
@@ -35,6 +47,7 @@ func connectTCP(ctx context.Context, baseLogger *logrus.Entry, address string, t
 		}
 
 		log.Info("Dialing TCP connection.")
+		setState(StateDialing, nil, nil)
 		conn, connErr = dialer.DialContext(ctx, "tcp", address)
 
 		if connErr != nil {
@@ -52,12 +65,21 @@ func connectTCP(ctx context.Context, baseLogger *logrus.Entry, address string, t
 
 	var backOffStrategy = backoff.WithContext(expBackoff, ctx)
 
-	defer log.Info("Connection closed.")
+	// Announce when the next attempt will be made
+	onBackoff := func(err error, wait time.Duration) {
+		nextRetry := time.Now().Add(wait)
+		setState(StateBackoff, err, &nextRetry)
+	}
+
+	defer func() {
+		log.Info("Connection closed.")
+		setState(StateIdle, nil, nil)
+	}()
 
 	for true {
 
 		backOffStrategy.Reset()
-		backoff.Retry(dialTCP, backOffStrategy)
+		backoff.RetryNotify(dialTCP, backOffStrategy, onBackoff)
 
 		// connection/ctx has been cancelled
 		if conn == nil {
@@ -65,13 +87,18 @@ func connectTCP(ctx context.Context, baseLogger *logrus.Entry, address string, t
 		}
 
 		log.Info("Connected.")
+		setState(StateConnected, nil, nil)
 
 		// Close connection if we break or return
 		defer conn.Close()
 
 		// create channel for reading data and go read
 		readChannel := make(chan []byte)
-		go tcpReader(log, conn, readChannel)
+		var readErr error
+		go func(conn net.Conn) {
+			readErr = tcpReader(log, conn, readChannel)
+			close(readChannel)
+		}(conn)
 
 		// Inner loop for handling data
 		disconnected := false
@@ -86,14 +113,28 @@ func connectTCP(ctx context.Context, baseLogger *logrus.Entry, address string, t
 					// Attempt to send data, if can not send immediately discard
 					onReceive(receivedData)
 				} else {
+					setState(StateFailed, readErr, nil)
 					disconnected = true
 					break
 				}
 
-			case i := <-tx:
+			case i, more := <-tx:
+				// Unsubscribed when the connection is cancelled
+				if !more {
+					return
+				}
 				data, _ := i.([]byte)
 				err := write(conn, data)
 				if err != nil {
+					setState(StateFailed, err, nil)
+					disconnected = true
+					break
+				}
+
+			case queued := <-queue:
+				err := writeQueued(conn, queued)
+				if err != nil {
+					setState(StateFailed, err, nil)
 					disconnected = true
 					break
 				}
@@ -103,10 +144,8 @@ func connectTCP(ctx context.Context, baseLogger *logrus.Entry, address string, t
 	}
 }
 
-// Helper to read from TCP connection
-func tcpReader(log *logrus.Entry, conn net.Conn, channel chan<- []byte) {
-
-	defer close(channel)
+// Helper to read from TCP connection, returns the error that ended reading
+func tcpReader(log *logrus.Entry, conn net.Conn, channel chan<- []byte) error {
 
 	buffer := make([]byte, 1024)
 
@@ -116,15 +155,18 @@ func tcpReader(log *logrus.Entry, conn net.Conn, channel chan<- []byte) {
 
 		if readErr != nil {
 			if readErr == io.EOF {
-				return
+				return errors.New("Connection closed by Senso.")
 			} else if err, ok := readErr.(net.Error); ok && err.Timeout() {
 				// Read timeout, just continue Nothing
 			} else {
 				// log.WithError(readErr).Error("Read error.")
-				return
+				return readErr
 			}
 		} else {
-			channel <- buffer[:readN]
+			// Hand out a copy, as the buffer is overwritten by the next read
+			data := make([]byte, readN)
+			copy(data, buffer[:readN])
+			channel <- data
 		}
 	}
 }
@@ -138,3 +180,18 @@ func write(conn net.Conn, data []byte) error {
 		return errors.New("Can not write to TCP connection, because not connected.")
 	}
 }
+
+// writeQueued writes queued data, unless the deadline of the data has passed, and reports the outcome to the writer.
+//
+// Returns an error only if the connection failed.
+func writeQueued(conn net.Conn, queued *queuedWrite) error {
+	if !queued.deadline.IsZero() && time.Now().After(queued.deadline) {
+		queued.done <- errors.New("Command expired before it could be written.")
+		return nil
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(commandWriteTimeout))
+	_, err := conn.Write(queued.data)
+	queued.done <- err
+	return err
+}
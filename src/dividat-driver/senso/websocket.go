@@ -6,12 +6,15 @@ import (
 	"errors"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/grandcat/zeroconf"
 	"github.com/sirupsen/logrus"
+
+	"github.com/dividat/driver/src/dividat-driver/senso/protocol"
 )
 
 // WEBSOCKET PROTOCOL
@@ -24,6 +27,10 @@ type Command struct {
 	*Disconnect
 
 	*Discover
+
+	*SetFormat
+
+	*SendCommand
 }
 
 func prettyPrintCommand(command Command) string {
@@ -35,6 +42,10 @@ func prettyPrintCommand(command Command) string {
 		return "Disconnect"
 	} else if command.Discover != nil {
 		return "Discover"
+	} else if command.SetFormat != nil {
+		return "SetFormat"
+	} else if command.SendCommand != nil {
+		return "SendCommand"
 	}
 	return "Unknown"
 }
@@ -42,9 +53,10 @@ func prettyPrintCommand(command Command) string {
 // GetStatus command
 type GetStatus struct{}
 
-// Connect command
+// Connect command, to a Senso at an address or with a serial
 type Connect struct {
 	Address string `json:"address"`
+	Serial  string `json:"serial"`
 }
 
 // Disconnect command
@@ -55,6 +67,29 @@ type Discover struct {
 	Duration int `json:"duration"`
 }
 
+// SetFormat command, selects how data from Senso is sent up the WebSocket
+type SetFormat struct {
+	Format string `json:"format"`
+}
+
+// SendCommand command, writes a request block to Senso and reports the outcome with a CommandResult message
+type SendCommand struct {
+	// Correlation ID, included in the CommandResult
+	Id        string `json:"id"`
+	BlockType uint16 `json:"blockType"`
+	Data      []byte `json:"data"`
+	// Milliseconds to wait for the response, a default is used if zero
+	Timeout int `json:"timeout"`
+}
+
+// Formats in which data from Senso can be sent
+const (
+	// Raw data as received from Senso, in binary messages (default)
+	FormatBinary = "binary"
+	// Decoded measurements and responses, in JSON messages
+	FormatJSON = "json"
+)
+
 // UnmarshalJSON implements encoding/json Unmarshaler interface
 func (command *Command) UnmarshalJSON(data []byte) error {
 
@@ -85,6 +120,18 @@ func (command *Command) UnmarshalJSON(data []byte) error {
 			return err
 		}
 
+	} else if temp.Type == "SetFormat" {
+		err := json.Unmarshal(data, &command.SetFormat)
+		if err != nil {
+			return err
+		}
+
+	} else if temp.Type == "SendCommand" {
+		err := json.Unmarshal(data, &command.SendCommand)
+		if err != nil {
+			return err
+		}
+
 	} else {
 		return errors.New("can not decode unknown command")
 	}
@@ -97,22 +144,47 @@ type Message struct {
 	*Status
 
 	Discovered *zeroconf.ServiceEntry
+
+	Measurement *protocol.Measurement
+	Response    *Response
+
+	ConnectionStateChanged *ChannelState
+
+	DeviceAppeared    *DiscoveredDevice
+	DeviceDisappeared *DiscoveredDevice
+
+	CommandResult *CommandResult
 }
 
 // Status is a message containing status information
 type Status struct {
-	Address *string
+	Address  *string
+	Device   *Device
+	Channels map[string]ConnectionState
+}
+
+// Response is a message containing a block received from Senso that is not a measurement, usually a response to a request on the control channel
+type Response struct {
+	BlockType uint16
+	// Decoded data, if the block type is known
+	Payload interface{}
+	// Raw data
+	Data []byte
 }
 
 // MarshalJSON ipmlements JSON encoder for messages
 func (message *Message) MarshalJSON() ([]byte, error) {
 	if message.Status != nil {
 		return json.Marshal(&struct {
-			Type    string  `json:"type"`
-			Address *string `json:"address"`
+			Type     string                     `json:"type"`
+			Address  *string                    `json:"address"`
+			Device   *Device                    `json:"device"`
+			Channels map[string]ConnectionState `json:"channels"`
 		}{
-			Type:    "Status",
-			Address: message.Status.Address,
+			Type:     "Status",
+			Address:  message.Status.Address,
+			Device:   message.Status.Device,
+			Channels: message.Status.Channels,
 		})
 
 	} else if message.Discovered != nil {
@@ -126,6 +198,84 @@ func (message *Message) MarshalJSON() ([]byte, error) {
 			IP:           append(message.Discovered.AddrIPv4, message.Discovered.AddrIPv6...),
 		})
 
+	} else if message.Measurement != nil {
+		return json.Marshal(&struct {
+			Type string `json:"type"`
+			*protocol.Measurement
+		}{
+			Type:        "Measurement",
+			Measurement: message.Measurement,
+		})
+
+	} else if message.ConnectionStateChanged != nil {
+		return json.Marshal(&struct {
+			Type    string `json:"type"`
+			Channel string `json:"channel"`
+			ConnectionState
+		}{
+			Type:            "ConnectionStateChanged",
+			Channel:         message.ConnectionStateChanged.Channel,
+			ConnectionState: message.ConnectionStateChanged.ConnectionState,
+		})
+
+	} else if message.DeviceAppeared != nil {
+		return json.Marshal(&struct {
+			Type string `json:"type"`
+			*DiscoveredDevice
+		}{
+			Type:             "DeviceAppeared",
+			DiscoveredDevice: message.DeviceAppeared,
+		})
+
+	} else if message.DeviceDisappeared != nil {
+		return json.Marshal(&struct {
+			Type string `json:"type"`
+			*DiscoveredDevice
+		}{
+			Type:             "DeviceDisappeared",
+			DiscoveredDevice: message.DeviceDisappeared,
+		})
+
+	} else if message.CommandResult != nil {
+		var response interface{}
+		if message.CommandResult.Response != nil {
+			response = &struct {
+				BlockType uint16      `json:"blockType"`
+				Payload   interface{} `json:"payload,omitempty"`
+				Data      []byte      `json:"data"`
+			}{
+				BlockType: message.CommandResult.Response.BlockType,
+				Payload:   message.CommandResult.Response.Payload,
+				Data:      message.CommandResult.Response.Data,
+			}
+		}
+		return json.Marshal(&struct {
+			Type     string      `json:"type"`
+			Id       string      `json:"id"`
+			Status   string      `json:"status"`
+			Error    string      `json:"error,omitempty"`
+			Response interface{} `json:"response"`
+		}{
+			Type:     "CommandResult",
+			Id:       message.CommandResult.Id,
+			Status:   message.CommandResult.Status,
+			Error:    message.CommandResult.Error,
+			Response: response,
+		})
+
+	} else if message.Response != nil {
+		return json.Marshal(&struct {
+			Type      string      `json:"type"`
+			BlockType uint16      `json:"blockType"`
+			Payload   interface{} `json:"payload,omitempty"`
+			Data      []byte      `json:"data"`
+		}{
+			Type:      "Response",
+			BlockType: message.Response.BlockType,
+			Payload:   message.Response.Payload,
+			Data:      message.Response.Data,
+		})
+
 	}
 
 	return nil, errors.New("could not marshal message")
@@ -134,6 +284,28 @@ func (message *Message) MarshalJSON() ([]byte, error) {
 
 // Implement net/http Handler interface
 func (handle *Handle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" && r.URL.Path == "/senso/device" {
+		handle.ServeDevice(w, r)
+	} else if r.Method == "GET" && r.URL.Path == "/senso/devices" {
+		handle.ServeDevices(w, r)
+	} else if r.URL.Path == "/senso/record" || strings.HasPrefix(r.URL.Path, "/senso/record/") {
+		handle.recorder.Serve(w, r, strings.TrimPrefix(r.URL.Path, "/senso/record"))
+	} else if r.URL.Path == "/senso" || r.URL.Path == "/senso/" {
+		handle.StreamData(w, r)
+	} else if handle.named != nil && handle.serveNamed(w, r) {
+		return
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+// StreamData upgrades to a WebSocket connection forwarding data from and to Senso
+func (handle *Handle) StreamData(w http.ResponseWriter, r *http.Request) {
+	handle.streamData(w, r, func() {})
+}
+
+// streamData does the work of StreamData, calling onClose once the client is gone
+func (handle *Handle) streamData(w http.ResponseWriter, r *http.Request, onClose func()) {
 
 	// Set up logger
 	var log = handle.log.WithFields(logrus.Fields{
@@ -146,6 +318,7 @@ func (handle *Handle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.WithError(err).Error("Could not upgrade connection to WebSocket.")
 		http.Error(w, "WebSocket upgrade error", http.StatusBadRequest)
+		onClose()
 		return
 	}
 
@@ -187,11 +360,24 @@ func (handle *Handle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return nil
 	}
 
-	// Create channels with data received from Senso
-	rx := handle.broker.Sub("rx")
+	// Create channels with data received from Senso, raw data is sent by default. Connection state changes and Sensos appearing or disappearing are always sent.
+	rx := handle.broker.Sub("rx", "state", "devices")
+
+	// Switch between raw and decoded data by changing the subscribed topic
+	setFormat := func(format string) {
+		if format == FormatJSON {
+			handle.broker.AddSub(rx, "rx-decoded")
+			handle.broker.Unsub(rx, "rx")
+		} else if format == FormatBinary {
+			handle.broker.AddSub(rx, "rx")
+			handle.broker.Unsub(rx, "rx-decoded")
+		} else {
+			log.WithField("format", format).Warning("Unknown format requested.")
+		}
+	}
 
 	// send data from Control and Data channel
-	go rx_data_loop(ctx, rx, sendBinary)
+	go rx_data_loop(ctx, rx, sendBinary, sendMessage)
 
 	// Helper function to close the connection
 	close := func() {
@@ -205,6 +391,8 @@ func (handle *Handle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		conn.Close()
 
 		log.Info("Websocket connection closed")
+
+		onClose()
 	}
 
 	// Main loop for the WebSocket connection
@@ -221,7 +409,7 @@ func (handle *Handle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 
 			if messageType == websocket.BinaryMessage {
-				handle.broker.TryPub(msg, "tx")
+				handle.transmit(msg)
 
 			} else if messageType == websocket.TextMessage {
 
@@ -233,6 +421,11 @@ func (handle *Handle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				}
 				log.WithField("command", prettyPrintCommand(command)).Debug("Received command.")
 
+				if command.SetFormat != nil {
+					setFormat(command.SetFormat.Format)
+					continue
+				}
+
 				err := handle.dispatchCommand(ctx, log, command, sendMessage)
 				if err != nil {
 					return
@@ -253,7 +446,11 @@ func (handle *Handle) dispatchCommand(ctx context.Context, log *logrus.Entry, co
 
 		var message Message
 
-		message.Status = &Status{Address: handle.Address}
+		message.Status = &Status{
+			Address:  handle.Address,
+			Device:   handle.GetDevice(),
+			Channels: handle.GetChannelStates(),
+		}
 
 		err := sendMessage(message)
 
@@ -262,20 +459,46 @@ func (handle *Handle) dispatchCommand(ctx context.Context, log *logrus.Entry, co
 		}
 
 	} else if command.Connect != nil {
-		handle.Connect(command.Connect.Address)
+		if handle.name != "" {
+			// Named connections are pinned to their serial
+			handle.ConnectSerial(handle.name)
+		} else if command.Connect.Serial != "" {
+			handle.ConnectSerial(command.Connect.Serial)
+		} else {
+			handle.Connect(command.Connect.Address)
+		}
 		return nil
 
 	} else if command.Disconnect != nil {
 		handle.Disconnect()
 		return nil
 
+	} else if command.SendCommand != nil {
+
+		timeout := defaultCommandTimeout
+		if command.SendCommand.Timeout > 0 {
+			timeout = time.Duration(command.SendCommand.Timeout) * time.Millisecond
+		}
+
+		go func(sendCommand SendCommand) {
+			result := handle.SendCommand(ctx, sendCommand.BlockType, sendCommand.Data, timeout)
+			result.Id = sendCommand.Id
+			if result.Status != CommandAcknowledged {
+				log.WithField("id", result.Id).WithField("blockType", sendCommand.BlockType).WithField("status", result.Status).Warning(result.Error)
+			}
+			sendMessage(Message{CommandResult: &result})
+		}(*command.SendCommand)
+
+		return nil
+
 	} else if command.Discover != nil {
 
-		discoveryCtx, _ := context.WithTimeout(ctx, time.Duration(command.Discover.Duration)*time.Second)
+		discoveryCtx, cancel := context.WithTimeout(ctx, time.Duration(command.Discover.Duration)*time.Second)
 
 		entries := handle.Discover(discoveryCtx)
 
 		go func(entries chan *zeroconf.ServiceEntry) {
+			defer cancel()
 			for entry := range entries {
 				log.WithField("service", entry).Debug("Discovered service.")
 
@@ -297,18 +520,23 @@ func (handle *Handle) dispatchCommand(ctx context.Context, log *logrus.Entry, co
 	return nil
 }
 
-// rx_data_loop reads data from Senso and forwards it up the WebSocket
-func rx_data_loop(ctx context.Context, rx chan interface{}, send func([]byte) error) {
+// rx_data_loop reads raw data or decoded messages from Senso and forwards them up the WebSocket
+func rx_data_loop(ctx context.Context, rx chan interface{}, sendBinary func([]byte) error, sendMessage func(Message) error) {
 	var err error
 	for {
 		select {
 		case <-ctx.Done():
 			return
 
-		case i := <-rx:
-			data, ok := i.([]byte)
-			if ok {
-				err = send(data)
+		case i, more := <-rx:
+			if !more {
+				return
+			}
+			switch data := i.(type) {
+			case []byte:
+				err = sendBinary(data)
+			case Message:
+				err = sendMessage(data)
 			}
 		}
 
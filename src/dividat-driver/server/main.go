@@ -4,11 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/dividat/driver/src/dividat-driver/firmware"
 	"github.com/dividat/driver/src/dividat-driver/flex"
 	"github.com/dividat/driver/src/dividat-driver/logging"
+	"github.com/dividat/driver/src/dividat-driver/recording"
 	"github.com/dividat/driver/src/dividat-driver/rfid"
 	"github.com/dividat/driver/src/dividat-driver/senso"
 )
@@ -22,7 +25,7 @@ var version string
 const serverPort = "8382"
 
 // Start the driver server
-func Start(logger *logrus.Logger, origins []string) context.CancelFunc {
+func Start(logger *logrus.Logger, origins []string, sensoConfig senso.Config, flexConfig flex.Config, recordingConfig recording.Config, firmwareConfig firmware.Config) context.CancelFunc {
 	// Log Server
 	logServer := logging.NewLogServer()
 	logger.AddHook(logServer)
@@ -49,13 +52,24 @@ func Start(logger *logrus.Logger, origins []string) context.CancelFunc {
 	// Setup a context
 	ctx, cancel := context.WithCancel(context.Background())
 
+	// Recordings of device streams
+	recordingConfig.DriverVersion = version
+	var recorders sync.WaitGroup
+	recordingConfig.Stopped = &recorders
+
 	// Setup Senso
-	sensoHandle := senso.New(ctx, baseLog.WithField("package", "senso"))
+	sensoConfig.Recording = recordingConfig
+	sensoHandle := senso.New(ctx, baseLog.WithField("package", "senso"), sensoConfig)
+	// net/http performs a redirect from `/senso` if only `/senso/` is mounted
 	http.Handle("/senso", corsHeaders(origins, sensoHandle))
+	http.Handle("/senso/", corsHeaders(origins, sensoHandle))
 
 	// Setup SensingTex reader
-	flexHandle := flex.New(ctx, baseLog.WithField("package", "flex"))
+	flexConfig.Recording = recordingConfig
+	flexHandle := flex.New(ctx, baseLog.WithField("package", "flex"), flexConfig)
+	// net/http performs a redirect from `/flex` if only `/flex/` is mounted
 	http.Handle("/flex", corsHeaders(origins, flexHandle))
+	http.Handle("/flex/", corsHeaders(origins, flexHandle))
 
 	// Setup RFID scanner
 	rfidHandle := rfid.NewHandle(ctx, baseLog.WithField("package", "rfid"))
@@ -63,6 +77,12 @@ func Start(logger *logrus.Logger, origins []string) context.CancelFunc {
 	http.Handle("/rfid", corsHeaders(origins, rfidHandle))
 	http.Handle("/rfid/", corsHeaders(origins, rfidHandle))
 
+	// Setup firmware updates
+	firmwareHandle := firmware.NewHandle(ctx, baseLog.WithField("package", "firmware"), firmwareConfig)
+	// net/http performs a redirect from `/firmware` if only `/firmware/` is mounted
+	http.Handle("/firmware", corsHeaders(origins, firmwareHandle))
+	http.Handle("/firmware/", corsHeaders(origins, firmwareHandle))
+
 	// Create a logger for server
 	log := baseLog.WithField("package", "server")
 
@@ -104,13 +124,18 @@ func Start(logger *logrus.Logger, origins []string) context.CancelFunc {
 
 	}()
 
-	return cancel
+	return func() {
+		cancel()
+		// Finish active recordings before the driver exits
+		recorders.Wait()
+	}
 }
 
 // Middleware for CORS headers, to be applied to any route that should be accessible from browser apps.
 func corsHeaders(origins []string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if len(r.Header["Origin"]) == 1 && contains(origins, r.Header["Origin"][0]) {
+		permitted := len(r.Header["Origin"]) == 1 && contains(origins, r.Header["Origin"][0])
+		if permitted {
 			w.Header().Set("Access-Control-Allow-Origin", r.Header["Origin"][0])
 			w.Header().Set("Access-Control-Allow-Private-Network", "true")
 		}
@@ -118,6 +143,13 @@ func corsHeaders(origins []string, next http.Handler) http.Handler {
 		// Announce that `Origin` header value may affect response
 		w.Header().Set("Vary", "Origin")
 
+		// Browsers send simple POST requests without asking first, so requests
+		// that change state are refused outright when coming from a foreign page.
+		if len(r.Header["Origin"]) > 0 && !permitted && !isSafeMethod(r.Method) {
+			http.Error(w, "Origin not permitted", http.StatusForbidden)
+			return
+		}
+
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(200)
 			return
@@ -127,6 +159,11 @@ func corsHeaders(origins []string, next http.Handler) http.Handler {
 	})
 }
 
+// isSafeMethod returns true for request methods that do not change state
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
 func contains(slice []string, candidate string) bool {
     for _, member := range slice {
         if member == candidate {
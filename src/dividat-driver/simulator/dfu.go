@@ -0,0 +1,189 @@
+package simulator
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pin/tftp"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dividat/driver/src/dividat-driver/senso/protocol"
+)
+
+// DefaultTftpPort is the port of the TFTP server run by the Senso bootloader
+const DefaultTftpPort = 69
+
+// Time the simulated Senso takes to reboot
+const rebootDuration = 2 * time.Second
+
+// Error code reported when a DFU command is rejected
+const dfuErrorCode = 1
+
+// Failure that can be injected into the simulation
+type Failure string
+
+// Injectable failures
+const (
+	// Reject DFU commands as if they carried the wrong magic key
+	FailWrongMagicKey Failure = "wrong-magic-key"
+	// Abort TFTP transfers after the first block
+	FailDropTftp Failure = "drop-tftp"
+	// Do not advertise the update service when in bootloader
+	FailNoAdvertisement Failure = "no-advertisement"
+	// Stay in bootloader after receiving an image
+	FailNoReturn Failure = "no-return"
+)
+
+var failures = []Failure{FailWrongMagicKey, FailDropTftp, FailNoAdvertisement, FailNoReturn}
+
+// ParseFailures parses a comma separated list of failures
+func ParseFailures(list string) (map[Failure]bool, error) {
+	parsed := make(map[Failure]bool)
+	if list == "" {
+		return parsed, nil
+	}
+	for _, name := range strings.Split(list, ",") {
+		known := false
+		for _, failure := range failures {
+			if Failure(name) == failure {
+				parsed[failure] = true
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown failure %q, expected one of %v", name, failures)
+		}
+	}
+	return parsed, nil
+}
+
+// acceptDfu returns true if the data of a DFU block carries the magic key
+func (senso *Senso) acceptDfu(log *logrus.Entry, data []byte) bool {
+	if len(data) != 8 || binary.BigEndian.Uint64(data) != protocol.DfuMagicKey {
+		log.Warning("Rejecting DFU command with wrong magic key.")
+		return false
+	} else if senso.config.Failures[FailWrongMagicKey] {
+		log.Warning("Rejecting DFU command (injected failure).")
+		return false
+	}
+	log.Info("Received DFU command.")
+	return true
+}
+
+// runBootloader serves TFTP until a firmware image has been received (returning nil) or ctx is done
+func (senso *Senso) runBootloader(parentCtx context.Context) error {
+	ctx, cancel := context.WithCancel(parentCtx)
+	defer cancel()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(rebootDuration):
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(senso.config.Address), Port: senso.config.TftpPort})
+	if err != nil {
+		return fmt.Errorf("Could not listen on UDP port %d: %v", senso.config.TftpPort, err)
+	}
+
+	received := make(chan struct{}, 1)
+	server := tftp.NewServer(nil, func(filename string, wt io.WriterTo) error {
+		err := senso.receiveImage(filename, wt)
+		if err == nil {
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+		}
+		return err
+	})
+	go server.Serve(conn)
+	defer server.Shutdown()
+
+	if senso.config.Failures[FailNoAdvertisement] {
+		senso.log.Warning("Not advertising update service (injected failure).")
+	} else {
+		mdns, err := senso.advertise("_sensoUpdate._udp", senso.config.TftpPort)
+		if err != nil {
+			return err
+		}
+		defer mdns.Shutdown()
+	}
+
+	senso.log.WithField("port", senso.config.TftpPort).Info("Bootloader waiting for firmware image.")
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-received:
+	}
+
+	if senso.config.Failures[FailNoReturn] {
+		senso.log.Warning("Staying in bootloader (injected failure).")
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	if senso.config.UpdatedFirmwareVersion != nil {
+		senso.config.FirmwareVersion = *senso.config.UpdatedFirmwareVersion
+	}
+
+	senso.log.Info("Rebooting into application.")
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(rebootDuration):
+		return nil
+	}
+}
+
+// receiveImage stores an image received via TFTP in the image directory
+func (senso *Senso) receiveImage(filename string, wt io.WriterTo) error {
+	path := filepath.Join(senso.config.ImageDir, filepath.Base(filename))
+	log := senso.log.WithField("path", path)
+	log.Info("Receiving firmware image.")
+
+	file, err := os.Create(path)
+	if err != nil {
+		log.WithError(err).Error("Could not create image file.")
+		return err
+	}
+	defer file.Close()
+
+	var writer io.Writer = file
+	if senso.config.Failures[FailDropTftp] {
+		writer = &droppingWriter{writer: file}
+	}
+
+	n, err := wt.WriteTo(writer)
+	if err != nil {
+		log.WithError(err).Error("Receiving firmware image failed.")
+		return err
+	}
+
+	log.WithField("bytes", n).Info("Received firmware image.")
+	return nil
+}
+
+// droppingWriter fails once the first block has been written, cutting the transfer short
+type droppingWriter struct {
+	writer  io.Writer
+	written int
+}
+
+func (w *droppingWriter) Write(p []byte) (int, error) {
+	if w.written > 0 {
+		return 0, errors.New("transfer dropped (injected failure)")
+	}
+	n, err := w.writer.Write(p)
+	w.written += n
+	return n, err
+}
@@ -0,0 +1,114 @@
+package simulator
+
+/* Simulates a Senso on the local machine.
+
+The simulator listens on the Senso control and data ports, replays a recording
+on the data channel and answers requests on the control channel. It can be used
+to exercise the driver without hardware:
+
+    dividat-driver simulate-senso rec/senso/simple.dat
+
+and connecting the driver to 127.0.0.1.
+
+A DFU command carrying the magic key makes the simulated Senso reboot into its
+bootloader, which advertises the update service and receives a firmware image
+via TFTP. Once the image is stored, the simulated Senso reboots back into the
+application. This allows testing firmware updates end-to-end:
+
+    dividat-driver simulate-senso -advertise
+    dividat-driver update-firmware -i controller-app.bin -force
+
+Failures can be injected with the -fail option.
+
+*/
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/dividat/driver/src/dividat-driver/senso/protocol"
+)
+
+// Command-line interface to the simulator
+func Command(flags []string) {
+	simulateFlags := flag.NewFlagSet("simulate-senso", flag.ExitOnError)
+	speed := simulateFlags.Float64("speed", 1, "Replay speed factor")
+	loop := simulateFlags.Bool("loop", true, "Start over at the end of the recording")
+	serial := simulateFlags.String("serial", "31-00000000", "Serial number of the simulated Senso")
+	firmwareVersion := simulateFlags.String("firmware", "3.8.0.0", "Firmware version reported by the simulated Senso")
+	updatedFirmwareVersion := simulateFlags.String("updated-firmware", "", "Firmware version reported after an update (default: unchanged)")
+	advertise := simulateFlags.Bool("advertise", false, "Advertise the simulated Senso via mDNS")
+	address := simulateFlags.String("address", "", "IP address to listen on and to advertise (default: all interfaces)")
+	tftpPort := simulateFlags.Int("tftp-port", DefaultTftpPort, "TFTP port of the simulated bootloader")
+	imageDir := simulateFlags.String("image-dir", os.TempDir(), "Directory where received firmware images are stored")
+	fail := simulateFlags.String("fail", "", fmt.Sprintf("Comma separated failures to inject (%v)", failures))
+	simulateFlags.Usage = func() {
+		fmt.Fprintf(simulateFlags.Output(), "Usage: %s simulate-senso [options] [recording]\n", os.Args[0])
+		simulateFlags.PrintDefaults()
+	}
+	simulateFlags.Parse(flags)
+
+	recording := "rec/senso/zero.dat"
+	if simulateFlags.NArg() > 0 {
+		recording = simulateFlags.Arg(0)
+	}
+
+	version, err := protocol.ParseVersion(*firmwareVersion)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	var updatedVersion *protocol.Version
+	if *updatedFirmwareVersion != "" {
+		parsed, err := protocol.ParseVersion(*updatedFirmwareVersion)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		updatedVersion = &parsed
+	}
+
+	injectedFailures, err := ParseFailures(*fail)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	log := logrus.New()
+	log.SetLevel(logrus.DebugLevel)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	senso := NewSenso(Config{
+		Recording:       recording,
+		Speed:           *speed,
+		Loop:            *loop,
+		Serial:          *serial,
+		FirmwareVersion: version,
+		Advertise:       *advertise,
+		Address:         *address,
+		TftpPort:        *tftpPort,
+		ImageDir:        *imageDir,
+		Failures:        injectedFailures,
+
+		UpdatedFirmwareVersion: updatedVersion,
+	}, logrus.NewEntry(log))
+
+	err = senso.Run(ctx)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,346 @@
+package simulator
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dividat/driver/src/dividat-driver/recording"
+	"github.com/dividat/driver/src/dividat-driver/senso/protocol"
+)
+
+const controlPort = 55567
+const dataPort = 55568
+
+// Config of a simulated Senso
+type Config struct {
+	// Recording replayed on the data channel
+	Recording string
+	Speed     float64
+	Loop      bool
+
+	Serial          string
+	FirmwareVersion protocol.Version
+	// Firmware version reported after an update, unchanged if nil
+	UpdatedFirmwareVersion *protocol.Version
+
+	// Advertise the control service via mDNS
+	Advertise bool
+
+	// IP address to listen on and to advertise, all interfaces if empty
+	Address string
+
+	// Port of the TFTP server in bootloader mode
+	TftpPort int
+	// Directory where received firmware images are stored
+	ImageDir string
+
+	// Failures to inject
+	Failures map[Failure]bool
+}
+
+// Senso is a simulated Senso
+type Senso struct {
+	config Config
+
+	dataConns      map[net.Conn]bool
+	dataConnsMutex *sync.Mutex
+
+	log *logrus.Entry
+}
+
+// NewSenso returns a simulated Senso
+func NewSenso(config Config, log *logrus.Entry) *Senso {
+	return &Senso{
+		config:         config,
+		dataConns:      make(map[net.Conn]bool),
+		dataConnsMutex: &sync.Mutex{},
+		log:            log,
+	}
+}
+
+// Run the simulation until ctx is done or a recording that is not looped ends
+func (senso *Senso) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Alternate between application and bootloader, like Senso does when updating firmware
+	modeErr := make(chan error, 1)
+	go func() {
+		for {
+			err := senso.runApplication(ctx)
+			if err == nil {
+				err = senso.runBootloader(ctx)
+			}
+			if err != nil || ctx.Err() != nil {
+				modeErr <- err
+				return
+			}
+		}
+	}()
+
+	replayErr := make(chan error, 1)
+	go func() {
+		senso.log.WithField("recording", senso.config.Recording).Info("Replaying recording.")
+		replayErr <- recording.Replay(ctx, senso.config.Recording, senso.config.Speed, senso.config.Loop, senso.broadcast)
+	}()
+
+	select {
+	case err := <-modeErr:
+		return err
+	case err := <-replayErr:
+		if err == context.Canceled {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		senso.log.Info("End of recording.")
+		return nil
+	}
+}
+
+// runApplication serves the control and data channels until a DFU command is
+// received (returning nil) or ctx is done
+func (senso *Senso) runApplication(parentCtx context.Context) error {
+	ctx, cancel := context.WithCancel(parentCtx)
+	defer cancel()
+
+	controlListener, err := listen(ctx, senso.config.Address, controlPort)
+	if err != nil {
+		return err
+	}
+	dataListener, err := listen(ctx, senso.config.Address, dataPort)
+	if err != nil {
+		return err
+	}
+
+	if senso.config.Advertise {
+		server, err := senso.advertise("_sensoControl._tcp", controlPort)
+		if err != nil {
+			return err
+		}
+		defer server.Shutdown()
+		senso.log.WithField("serial", senso.config.Serial).Info("Advertising via mDNS.")
+	}
+
+	dfu := make(chan struct{})
+	var dfuOnce sync.Once
+	reboot := func() {
+		dfuOnce.Do(func() { close(dfu) })
+	}
+
+	go acceptLoop(controlListener, func(conn net.Conn) { senso.serveControl(ctx, conn, reboot) })
+	go acceptLoop(dataListener, func(conn net.Conn) { senso.serveData(ctx, conn) })
+
+	senso.log.WithField("version", senso.config.FirmwareVersion.String()).Info("Application running.")
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-dfu:
+		senso.log.Info("Rebooting into bootloader.")
+		return nil
+	}
+}
+
+// advertise a service via mDNS, with the configured address if there is one
+func (senso *Senso) advertise(service string, port int) (*zeroconf.Server, error) {
+	instance := "Senso simulator " + senso.config.Serial
+	text := []string{"ser_no=" + senso.config.Serial}
+
+	var server *zeroconf.Server
+	var err error
+	if senso.config.Address == "" {
+		server, err = zeroconf.Register(instance, service, "local.", port, text, nil)
+	} else {
+		host := "senso-simulator-" + senso.config.Serial
+		server, err = zeroconf.RegisterProxy(instance, service, "local.", port, host, []string{senso.config.Address}, text, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not advertise via mDNS: %v", err)
+	}
+	return server, nil
+}
+
+// listen on a port until ctx is done
+func listen(ctx context.Context, address string, port int) (net.Listener, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(address, strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("Could not listen on port %d: %v", port, err)
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	return listener, nil
+}
+
+func acceptLoop(listener net.Listener, serve func(net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go serve(conn)
+	}
+}
+
+// closeWhenDone closes conn when ctx is done, the returned function stops waiting
+func closeWhenDone(ctx context.Context, conn net.Conn) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// DATA CHANNEL
+
+func (senso *Senso) serveData(ctx context.Context, conn net.Conn) {
+	log := senso.log.WithField("channel", "data").WithField("remoteAddress", conn.RemoteAddr().String())
+	log.Info("Connection opened.")
+
+	stop := closeWhenDone(ctx, conn)
+	defer stop()
+
+	senso.dataConnsMutex.Lock()
+	senso.dataConns[conn] = true
+	senso.dataConnsMutex.Unlock()
+
+	// Data is written by broadcast, wait for the connection to be closed by the other side
+	buffer := make([]byte, 1024)
+	for {
+		_, err := conn.Read(buffer)
+		if err != nil {
+			break
+		}
+	}
+
+	senso.dataConnsMutex.Lock()
+	delete(senso.dataConns, conn)
+	senso.dataConnsMutex.Unlock()
+
+	conn.Close()
+	log.Info("Connection closed.")
+}
+
+// broadcast data to all data channel connections
+func (senso *Senso) broadcast(data []byte) {
+	senso.dataConnsMutex.Lock()
+	defer senso.dataConnsMutex.Unlock()
+
+	for conn := range senso.dataConns {
+		conn.Write(data)
+	}
+}
+
+// CONTROL CHANNEL
+
+func (senso *Senso) serveControl(ctx context.Context, conn net.Conn, reboot func()) {
+	defer conn.Close()
+	stop := closeWhenDone(ctx, conn)
+	defer stop()
+
+	log := senso.log.WithField("channel", "control").WithField("remoteAddress", conn.RemoteAddr().String())
+	log.Info("Connection opened.")
+	defer log.Info("Connection closed.")
+
+	decoder := protocol.NewDecoder()
+	buffer := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return
+		}
+		decoder.Write(buffer[:n])
+
+		for {
+			packet, err := decoder.Next()
+			if err != nil {
+				log.WithError(err).Warning("Could not decode request.")
+				continue
+			} else if packet == nil {
+				break
+			}
+
+			for _, block := range packet.Blocks {
+				log.WithField("blockType", fmt.Sprintf("0x%04X", block.Type)).Debug("Received request.")
+				if block.Type == protocol.BlockTypeDfu && senso.acceptDfu(log, block.Data) {
+					// Senso reboots without responding
+					reboot()
+					return
+				}
+				_, err := conn.Write(senso.respond(block).Encode())
+				if err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// respond returns the response to a request
+func (senso *Senso) respond(request protocol.Block) *protocol.Packet {
+	var data []byte
+
+	switch request.Type {
+	case protocol.BlockTypeDevInfo:
+		data = senso.devInfo().Encode()
+	case protocol.BlockTypeVccInfo:
+		data = senso.vccInfo().Encode()
+	case protocol.BlockTypeDfu:
+		// Only reached if the DFU command was rejected
+		data = make([]byte, 12)
+		binary.LittleEndian.PutUint32(data[4:], dfuErrorCode)
+	default:
+		// Standard response, status and error code are zero
+		data = make([]byte, 12)
+	}
+
+	return &protocol.Packet{
+		Header: protocol.Header{ProtocolVersion: protocol.MaxProtocolVersion, NumberOfBlocks: 1},
+		Blocks: []protocol.Block{protocol.Block{Type: request.Type | protocol.ResponseFlag, Data: data}},
+	}
+}
+
+func (senso *Senso) devInfo() *protocol.DevInfo {
+	devInfo := protocol.DevInfo{
+		Controller: protocol.DevInfoItem{
+			SoftwareVersion: senso.config.FirmwareVersion,
+			SerialNumber:    senso.config.Serial,
+		},
+	}
+	for ix := 0; ix < protocol.NumberOfPlates; ix++ {
+		devInfo.LedBoards = append(devInfo.LedBoards, protocol.DevInfoItem{
+			SoftwareVersion: senso.config.FirmwareVersion,
+			SerialNumber:    fmt.Sprintf("30-%08d", ix+1),
+		})
+	}
+	return &devInfo
+}
+
+func (senso *Senso) vccInfo() *protocol.VccInfo {
+	item := protocol.VccInfoItem{
+		Vcc3V3:      3300,
+		Vcc5V:       5000,
+		Vcc12VMotor: 12000,
+		Vcc12VLed:   12000,
+		Vcc19VLed:   19000,
+		Temperature: 250,
+	}
+	vccInfo := protocol.VccInfo{Controller: item}
+	for ix := 0; ix < protocol.NumberOfPlates; ix++ {
+		vccInfo.LedBoards = append(vccInfo.LedBoards, item)
+	}
+	return &vccInfo
+}
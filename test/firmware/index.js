@@ -0,0 +1,286 @@
+/* eslint-env mocha */
+const { wait, startDriver, runDriver, connectWS, getJSON, expectEvent } = require('../utils')
+const expect = require('chai').expect
+const rp = require('request-promise')
+const crypto = require('crypto')
+const fs = require('fs')
+const os = require('os')
+const path = require('path')
+
+// Key pair standing in for the release key, which is not available to tests
+const { publicKey, privateKey } = crypto.generateKeyPairSync('ec', { namedCurve: 'prime256v1' })
+const publicKeyPath = path.join(os.tmpdir(), 'dividat-driver-test-firmware-key.pem')
+
+// Image starting with a vector table of a Cortex-M application
+function firmwareImage () {
+  const image = Buffer.alloc(1024)
+  image.writeUInt32LE(0x20008000, 0)
+  image.writeUInt32LE(0x08000101, 4)
+  return image
+}
+
+function sign (data) {
+  return crypto.createSign('SHA256').update(data).sign(privateKey, 'base64')
+}
+
+// TESTS
+
+describe('Basic functionality', () => {
+  var driver
+
+  beforeEach(async () => {
+  // Start driver
+    var code = 0
+    fs.writeFileSync(publicKeyPath, publicKey.export({ type: 'spki', format: 'pem' }))
+    driver = startDriver(['--firmware-key', publicKeyPath]).on('exit', (c) => {
+      code = c
+    })
+  // Give driver 500ms to start up
+    await wait(500)
+    expect(code).to.be.equal(0)
+    driver.removeAllListeners()
+  })
+
+  afterEach(() => {
+    driver.kill()
+  })
+
+  function postUpdate (formData, headers) {
+    return rp({
+      method: 'POST',
+      uri: 'http://127.0.0.1:8382/firmware/update',
+      headers: headers,
+      formData: formData,
+      resolveWithFullResponse: true,
+      simple: false
+    })
+  }
+
+  it('Rejects an update without image.', async function () {
+    this.timeout(500)
+
+    const response = await postUpdate({ address: '127.0.0.1' })
+    expect(response.statusCode).to.be.equal(400)
+  })
+
+  it('Reports an unsigned image without vector table.', async function () {
+    this.timeout(500)
+
+    const image = Buffer.alloc(1024)
+    const response = await postUpdate({
+      image: { value: image, options: { filename: 'controller-app.bin' } },
+      address: '127.0.0.1'
+    })
+    expect(response.statusCode).to.be.equal(400)
+    expect(response.body).to.contain('initial stack pointer 0x00000000 is outside of the SRAM region')
+  })
+
+  it('Accepts a signed image regardless of its vector table.', async function () {
+    this.timeout(500)
+
+    // Stack pointer outside of the SRAM region of the ARMv7-M default memory map
+    const image = firmwareImage()
+    image.writeUInt32LE(0x10008000, 0)
+    const response = await postUpdate({
+      image: { value: image, options: { filename: 'controller-app.bin' } },
+      signature: sign(image),
+      address: '127.0.0.1'
+    })
+    expect(response.statusCode).to.be.equal(202)
+  })
+
+  it('Refuses to flash an unsigned image.', async function () {
+    this.timeout(500)
+
+    const response = await postUpdate({
+      image: { value: firmwareImage(), options: { filename: 'controller-app.bin' } },
+      address: '127.0.0.1'
+    })
+    expect(response.statusCode).to.be.equal(400)
+    expect(response.body).to.contain('Image is neither signed nor described by a signed manifest.')
+  })
+
+  it('Refuses to flash an image with a bad signature.', async function () {
+    this.timeout(500)
+
+    const image = firmwareImage()
+    const otherImage = firmwareImage()
+    otherImage.writeUInt32LE(0x08000103, 4)
+    const response = await postUpdate({
+      image: { value: image, options: { filename: 'controller-app.bin' } },
+      signature: sign(otherImage),
+      address: '127.0.0.1'
+    })
+    expect(response.statusCode).to.be.equal(400)
+    expect(response.body).to.contain('Image signature invalid: signature does not match')
+  })
+
+  it('Reports failure of an update over WebSocket.', async function () {
+    this.timeout(2000)
+
+    const ws = await connectWS('ws://127.0.0.1:8382/firmware')
+    const failed = expectEvent(ws, 'message', (msg) => {
+      const progress = JSON.parse(msg)
+      return progress.type === 'Progress' && progress.stage === 'Failed'
+    })
+
+    // No Senso is listening on the local control port
+    const image = firmwareImage()
+    const response = await postUpdate({
+      image: { value: image, options: { filename: 'controller-app.bin' } },
+      signature: sign(image),
+      address: '127.0.0.1'
+    })
+    expect(response.statusCode).to.be.equal(202)
+
+    await failed
+
+    const latest = await getJSON('http://127.0.0.1:8382/firmware/update')
+    expect(latest.stage).to.be.equal('Failed')
+  })
+
+  it('Rejects an update from a foreign origin.', async function () {
+    this.timeout(500)
+
+    const image = firmwareImage()
+    const response = await postUpdate({
+      image: { value: image, options: { filename: 'controller-app.bin' } },
+      signature: sign(image),
+      address: '127.0.0.1'
+    }, { Origin: 'https://evil.example' })
+    expect(response.statusCode).to.be.equal(403)
+
+    const latest = await getJSON('http://127.0.0.1:8382/firmware/update')
+    expect(latest).to.be.equal(null)
+  })
+
+  it('Refuses to flash an unverified image even if forced.', async function () {
+    this.timeout(500)
+
+    const response = await postUpdate({
+      image: { value: firmwareImage(), options: { filename: 'controller-app.bin' } },
+      address: '127.0.0.1',
+      force: 'true'
+    })
+    expect(response.statusCode).to.be.equal(400)
+  })
+})
+
+// Run update-firmware with a signed image, resolving with exit code and output
+const imagePath = path.join(os.tmpdir(), 'dividat-driver-test-controller-app.bin')
+
+function update (args) {
+  const image = firmwareImage()
+  fs.writeFileSync(imagePath, image)
+  fs.writeFileSync(imagePath + '.sig', sign(image))
+  fs.writeFileSync(publicKeyPath, publicKey.export({ type: 'spki', format: 'pem' }))
+
+  return runDriver(['update-firmware', '-i', imagePath, '-key', publicKeyPath].concat(args))
+}
+
+describe('Update confirmation', () => {
+  var simulator
+
+  afterEach(() => {
+    simulator.kill()
+  })
+
+  it('Confirms an update by a changed version.', async function () {
+    this.timeout(30000)
+
+    simulator = startDriver(['simulate-senso', '-address', '127.0.0.1', '-firmware', '3.8.0.0', '-updated-firmware', '3.9.0.0', 'rec/senso/zero.dat'])
+    await wait(500)
+
+    const result = await update(['-a', '127.0.0.1'])
+    expect(result.code).to.be.equal(0)
+  })
+
+  it('Fails an update without expected version if the version is unchanged.', async function () {
+    this.timeout(30000)
+
+    simulator = startDriver(['simulate-senso', '-address', '127.0.0.1', '-firmware', '3.8.0.0', 'rec/senso/zero.dat'])
+    await wait(500)
+
+    const result = await update(['-a', '127.0.0.1'])
+    expect(result.code).to.be.equal(5)
+    expect(result.output).to.contain('Senso still reports firmware 3.8.0.0 after the update')
+  })
+
+  it('Confirms an update to the same version if it is expected.', async function () {
+    this.timeout(30000)
+
+    simulator = startDriver(['simulate-senso', '-address', '127.0.0.1', '-firmware', '3.8.0.0', 'rec/senso/zero.dat'])
+    await wait(500)
+
+    const result = await update(['-a', '127.0.0.1', '-expect-version', '3.8.0.0'])
+    expect(result.code).to.be.equal(0)
+  })
+})
+
+describe('Batch updates', () => {
+  var simulator
+
+  beforeEach(async () => {
+    simulator = startDriver(['simulate-senso', '-address', '127.0.0.1', '-advertise', '-serial', '31-00000101', '-updated-firmware', '3.9.0.0', 'rec/senso/zero.dat'])
+    await wait(500)
+  })
+
+  afterEach(() => {
+    simulator.kill()
+  })
+
+  it('Updates all discovered Sensos.', async function () {
+    this.timeout(60000)
+
+    const result = await update(['-all', '-concurrency', '2'])
+    expect(result.code).to.be.equal(0)
+    expect(result.output).to.contain('Updating 1 Sensos: 31-00000101')
+    expect(result.output).to.match(/31-00000101 +Done/)
+  })
+
+  it('Summarizes the outcome of every update and exits with the highest exit code.', async function () {
+    this.timeout(60000)
+
+    const result = await update(['-s', '31-00000101,31-00000199', '-concurrency', '2'])
+    expect(result.code).to.be.equal(1)
+    expect(result.output).to.match(/31-00000101 +Done/)
+    expect(result.output).to.match(/31-00000199 +Failed +Could not find Senso 31-00000199\./)
+  })
+})
+
+describe('Listing Sensos', () => {
+  var simulator
+
+  beforeEach(async () => {
+    simulator = startDriver(['simulate-senso', '-address', '127.0.0.1', '-advertise', '-serial', '31-00000121', 'rec/senso/zero.dat'])
+    await wait(500)
+  })
+
+  afterEach(() => {
+    simulator.kill()
+  })
+
+  it('Lists discovered Sensos as table.', async function () {
+    this.timeout(5000)
+
+    const result = await runDriver(['list-sensos', '-duration', '2s'])
+    expect(result.code).to.be.equal(0)
+    const lines = result.output.trim().split('\n')
+    expect(lines[0]).to.match(/^SERIAL +MODE +ADDRESSES +PORT +TXT$/)
+    const row = lines.find((line) => line.startsWith('31-00000121'))
+    expect(row).to.match(/^31-00000121 +application +127\.0\.0\.1 +55567 +ser_no=31-00000121$/)
+  })
+
+  it('Lists discovered Sensos as JSON.', async function () {
+    this.timeout(5000)
+
+    const result = await runDriver(['list-sensos', '-duration', '2s', '-format', 'json'])
+    expect(result.code).to.be.equal(0)
+    const listing = JSON.parse(result.output).find((l) => l.serial === '31-00000121')
+    expect(listing.mode).to.be.equal('application')
+    expect(listing.service).to.be.equal('_sensoControl._tcp')
+    expect(listing.ipv4).to.deep.equal(['127.0.0.1'])
+    expect(listing.port).to.be.equal(55567)
+    expect(listing.txt).to.include('ser_no=31-00000121')
+  })
+})
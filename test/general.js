@@ -40,3 +40,10 @@ it('Get log entries from HTTP endpoint.', async () => {
   expect(logs).to.be.an('array')
   expect(logs[0]).to.include({level: 'info', msg: 'Dividat Driver starting'})
 })
+
+it('Starting the driver with an invalid Flex port rule fails.', (done) => {
+  startDriver(['-flex-port', 'vendor=16C0']).on('exit', (c) => {
+    expect(c).to.be.equal(1)
+    done()
+  })
+})
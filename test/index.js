@@ -7,6 +7,13 @@ describe('Senso', () => {
   require('./senso')
 })
 
+describe('Recording', () => {
+  require('./recording')
+})
+
+describe('Firmware', () => {
+  require('./firmware')
+})
 
 describe('RFID', () => {
   require('./rfid')
@@ -0,0 +1,365 @@
+/* eslint-env mocha */
+const { wait, startDriver, runDriver, connectWS, getJSON, expectEvent } = require('../utils')
+const expect = require('chai').expect
+const rp = require('request-promise')
+const fs = require('fs')
+const os = require('os')
+const path = require('path')
+const zlib = require('zlib')
+
+const mock = require('../senso/mock')
+
+// TESTS
+
+describe('Basic functionality', () => {
+  var driver
+  var senso = {}
+  var recordingDir
+
+  beforeEach(async () => {
+    recordingDir = fs.mkdtempSync(path.join(os.tmpdir(), 'dividat-driver-recordings-'))
+
+  // Start driver
+    var code = 0
+    driver = startDriver(['-recording-dir', recordingDir]).on('exit', (c) => {
+      code = c
+    })
+  // Give driver 500ms to start up
+    await wait(500)
+    expect(code).to.be.equal(0)
+    driver.removeAllListeners()
+
+  // start a mock Senso
+    senso.data = mock.dataChannel()
+    senso.control = mock.controlChannel()
+  })
+
+  afterEach(() => {
+    driver.kill()
+
+    senso.data.close()
+    senso.control.close()
+  })
+
+  function request (method, uri, headers) {
+    return rp({
+      method: method,
+      uri: 'http://127.0.0.1:8382' + uri,
+      headers: headers,
+      resolveWithFullResponse: true,
+      simple: false
+    })
+  }
+
+  it('Only one recording can be active', async function () {
+    this.timeout(500)
+
+    const started = await request('POST', '/senso/record/start')
+    expect(started.statusCode).to.be.equal(201)
+
+    const again = await request('POST', '/senso/record/start')
+    expect(again.statusCode).to.be.equal(409)
+
+    const stopped = await request('POST', '/senso/record/stop')
+    expect(stopped.statusCode).to.be.equal(200)
+
+    const stoppedAgain = await request('POST', '/senso/record/stop')
+    expect(stoppedAgain.statusCode).to.be.equal(409)
+  })
+
+  it('Received and sent packets are recorded', async function () {
+    this.timeout(3000)
+
+    const sensoWS = await connectWS('ws://127.0.0.1:8382/senso')
+    sensoWS.send(JSON.stringify({ type: 'Connect', address: '127.0.0.1' }))
+    // Wait for both channels and the device query on connect
+    await wait(1500)
+
+    const started = JSON.parse((await request('POST', '/senso/record/start')).body)
+
+    senso.data.stream.write(Buffer.from([1, 2, 3, 4]))
+    sensoWS.send(Buffer.from([5, 6, 7, 8]))
+    await wait(100)
+
+    const stopped = JSON.parse((await request('POST', '/senso/record/stop')).body)
+    expect(stopped.name).to.be.equal(started.name)
+    expect(stopped.packets).to.be.equal(2)
+
+    const list = JSON.parse((await request('GET', '/senso/record')).body)
+    expect(list.active).to.be.equal(null)
+    expect(list.recordings.map((r) => r.name)).to.include(started.name)
+
+    const download = await request('GET', '/senso/record/' + started.name)
+    const lines = download.body.trim().split('\n')
+    const metadata = JSON.parse(lines[0])
+    expect(metadata.version).to.be.equal(2)
+    expect(metadata.device).to.be.equal('senso')
+    expect(metadata.source).to.be.equal('driver')
+    expect(lines[1]).to.match(/^\d+, rx, AQIDBA==$/)
+    expect(lines[2]).to.match(/^\d+, tx, BQYHCA==$/)
+  })
+
+  it('Recordings can not be controlled from foreign origins', async function () {
+    this.timeout(500)
+
+    const started = await request('POST', '/senso/record/start', { Origin: 'https://evil.example' })
+    expect(started.statusCode).to.be.equal(403)
+
+    const list = JSON.parse((await request('GET', '/senso/record')).body)
+    expect(list.active).to.be.equal(null)
+  })
+
+  it('The active recording is finished when the driver stops', async function () {
+    this.timeout(3000)
+
+    // Restart the driver with compression, so that a missing gzip trailer would be noticed
+    driver.kill()
+    await wait(200)
+    driver = startDriver(['-recording-dir', recordingDir, '-recording-compress'])
+    await wait(500)
+
+    const sensoWS = await connectWS('ws://127.0.0.1:8382/senso')
+    sensoWS.send(JSON.stringify({ type: 'Connect', address: '127.0.0.1' }))
+    await wait(1500)
+
+    const started = JSON.parse((await request('POST', '/senso/record/start')).body)
+    senso.data.stream.write(Buffer.from([1, 2, 3, 4]))
+    await wait(100)
+
+    const exited = new Promise((resolve) => driver.on('exit', resolve))
+    driver.kill()
+    await exited
+
+    const lines = zlib.gunzipSync(fs.readFileSync(path.join(recordingDir, started.name))).toString().trim().split('\n')
+    expect(JSON.parse(lines[0]).device).to.be.equal('senso')
+    expect(lines[1]).to.match(/^\d+, rx, AQIDBA==$/)
+  })
+})
+
+describe('Replay', () => {
+  var driver
+
+  beforeEach(async () => {
+  // Start driver, replaying a Flex recording and storing recordings in rec/senso
+    var code = 0
+    driver = startDriver(['-flex-source', 'replay://rec/flex/zero.dat', '-recording-dir', 'rec/senso']).on('exit', (c) => {
+      code = c
+    })
+  // Give driver 500ms to start up
+    await wait(500)
+    expect(code).to.be.equal(0)
+    driver.removeAllListeners()
+  })
+
+  afterEach(() => {
+    driver.kill()
+  })
+
+  it('Recordings are replayed as a virtual Senso', async function () {
+    this.timeout(1000)
+
+    const sensoWS = await connectWS('ws://127.0.0.1:8382/senso')
+    const received = new Promise((resolve, reject) => {
+      sensoWS.on('message', (msg) => {
+        if (typeof msg !== 'string') {
+          resolve()
+        }
+      })
+    })
+    sensoWS.send(JSON.stringify({ type: 'Connect', address: 'replay://zero.dat' }))
+
+    return received
+  })
+
+  it('Only recordings in the recording directory are replayed', async function () {
+    this.timeout(1000)
+
+    const sensoWS = await connectWS('ws://127.0.0.1:8382/senso')
+    for (const address of ['replay:///etc/passwd', 'replay://../flex/zero.dat']) {
+      const refused = new Promise((resolve, reject) => {
+        sensoWS.on('message', (msg) => {
+          if (typeof msg !== 'string') {
+            reject(new Error('Received data of ' + address))
+            return
+          }
+          const event = JSON.parse(msg)
+          if (event.type === 'ConnectionStateChanged' && event.channel === 'data') {
+            expect(event.state).to.be.equal('Idle')
+            expect(event.address).to.be.equal(address)
+            expect(event.error).to.match(/recording directory/)
+            resolve()
+          }
+        })
+      })
+      sensoWS.send(JSON.stringify({ type: 'Connect', address: address }))
+      await refused
+      sensoWS.removeAllListeners('message')
+    }
+  })
+
+  it('Flex recordings are replayed in place of serial devices', async function () {
+    this.timeout(1000)
+
+    const flexWS = await connectWS('ws://127.0.0.1:8382/flex')
+    return new Promise((resolve, reject) => {
+      flexWS.on('message', (msg) => {
+        resolve()
+      })
+    })
+  })
+
+  it('Flex status is sent and available with HTTP get', async function () {
+    this.timeout(1000)
+
+    const flexWS = await connectWS('ws://127.0.0.1:8382/flex')
+    const status = await expectEvent(flexWS, 'message', (msg) => JSON.parse(msg).state === 'Connected').then(JSON.parse)
+    expect(status.type).to.be.equal('Status')
+    expect(status.port.name).to.be.equal('replay://rec/flex/zero.dat')
+
+    const polled = await getJSON('http://127.0.0.1:8382/flex/status')
+    expect(polled.state).to.be.equal('Connected')
+  })
+
+  it('Flex frames are decoded after SetFormat', async function () {
+    this.timeout(1000)
+
+    const flexWS = await connectWS('ws://127.0.0.1:8382/flex')
+    flexWS.send(JSON.stringify({ type: 'SetFormat', format: 'json' }))
+    const frame = await new Promise((resolve, reject) => {
+      flexWS.on('message', (msg) => {
+        if (typeof msg === 'string') {
+          resolve(JSON.parse(msg))
+        }
+      })
+    })
+
+    expect(frame.type).to.be.equal('Frame')
+    expect(frame.matrix).to.have.lengthOf(frame.rows)
+    frame.matrix.forEach((row) => expect(row).to.have.lengthOf(frame.columns))
+  })
+})
+
+describe('Replay of several Flex devices', () => {
+  var driver
+  const left = 'replay://rec/flex/zero.dat'
+  const right = 'replay://rec/flex/zero.dat?speed=2'
+
+  beforeEach(async () => {
+  // Start driver, replaying a Flex recording as two devices
+    var code = 0
+    driver = startDriver(['-flex-source', left, '-flex-source', right]).on('exit', (c) => {
+      code = c
+    })
+  // Give driver 500ms to start up
+    await wait(500)
+    expect(code).to.be.equal(0)
+    driver.removeAllListeners()
+  })
+
+  afterEach(() => {
+    driver.kill()
+  })
+
+  it('Flex devices are listed', async function () {
+    this.timeout(1000)
+
+    const flexWS = await connectWS('ws://127.0.0.1:8382/flex')
+    await wait(200)
+    flexWS.send(JSON.stringify({ type: 'GetDevices' }))
+    const devices = await expectEvent(flexWS, 'message', (msg) => JSON.parse(msg).type === 'Devices').then(JSON.parse)
+    expect(devices.devices.map((device) => device.device)).to.be.deep.equal([left, right])
+    devices.devices.forEach((device) => expect(device.state).to.be.equal('Connected'))
+    expect(devices.devices.filter((device) => device.primary)).to.have.lengthOf(1)
+
+    const polled = await getJSON('http://127.0.0.1:8382/flex/devices')
+    expect(polled).to.have.lengthOf(2)
+  })
+
+  it('Raw sets of the primary device are sent unless subscribed to a device', async function () {
+    this.timeout(3000)
+
+    // Count binary messages of a connection during one second
+    function countSets (ws) {
+      var count = 0
+      ws.on('message', (msg) => {
+        if (typeof msg !== 'string') {
+          count++
+        }
+      })
+      return wait(1000).then(() => count)
+    }
+
+    const flexWS = await connectWS('ws://127.0.0.1:8382/flex')
+    await wait(200)
+    flexWS.send(JSON.stringify({ type: 'GetDevices' }))
+    const devices = await expectEvent(flexWS, 'message', (msg) => typeof msg === 'string' && JSON.parse(msg).type === 'Devices').then(JSON.parse)
+    const primary = devices.devices.find((device) => device.primary).device
+
+    // The right device replays twice as fast, so the rates tell the devices apart
+    const primaryWS = await connectWS('ws://127.0.0.1:8382/flex')
+    primaryWS.send(JSON.stringify({ type: 'Subscribe', device: primary }))
+    await wait(100)
+    const counts = await Promise.all([countSets(flexWS), countSets(primaryWS)])
+
+    expect(counts[1]).to.be.above(0)
+    expect(counts[0]).to.be.within(counts[1] * 0.8, counts[1] * 1.25)
+  })
+
+  it('Flex frames are tagged by device and can be subscribed to by device', async function () {
+    this.timeout(1000)
+
+    const flexWS = await connectWS('ws://127.0.0.1:8382/flex')
+    flexWS.send(JSON.stringify({ type: 'Subscribe', device: right }))
+    flexWS.send(JSON.stringify({ type: 'SetFormat', format: 'json' }))
+    const frames = await new Promise((resolve, reject) => {
+      const received = []
+      flexWS.on('message', (msg) => {
+        if (typeof msg === 'string' && JSON.parse(msg).type === 'Frame') {
+          received.push(JSON.parse(msg))
+          if (received.length === 5) {
+            resolve(received)
+          }
+        }
+      })
+    })
+
+    frames.forEach((frame) => expect(frame.device).to.be.equal(right))
+  })
+})
+
+describe('Inspecting recordings', () => {
+  it('Senso recordings are summarized', async function () {
+    this.timeout(2000)
+
+    const result = await runDriver(['inspect-recording', 'rec/senso/zero.dat'])
+    expect(result.code).to.be.equal(0)
+    expect(result.output).to.contain('Device:       senso')
+    expect(result.output).to.contain('Packets:      1803 received, 0 sent')
+    expect(result.output).to.contain('Malformed:    0')
+    expect(result.output).to.contain('No gaps.')
+    expect(result.output).to.match(/^5 +-1 +193\.4 +366$/m)
+  })
+
+  it('Senso Flex recordings are summarized as JSON', async function () {
+    this.timeout(2000)
+
+    const result = await runDriver(['inspect-recording', '-device', 'flex', '-format', 'json', 'rec/flex/zero.dat'])
+    expect(result.code).to.be.equal(0)
+    const report = JSON.parse(result.output)
+    expect(report.device).to.be.equal('flex')
+    expect(report.received).to.be.equal(831)
+    expect(report.frames).to.be.equal(831)
+    expect(report.malformed).to.be.equal(0)
+    expect(report.gaps).to.be.empty
+    expect(report.samples.count).to.be.equal(6568)
+    expect(report.samples.min).to.be.equal(1)
+    expect(report.samples.max).to.be.equal(14)
+  })
+
+  it('Missing recordings are reported', async function () {
+    this.timeout(2000)
+
+    const result = await runDriver(['inspect-recording', 'rec/senso/missing.dat'])
+    expect(result.code).to.be.equal(1)
+  })
+})
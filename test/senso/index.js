@@ -1,7 +1,11 @@
 /* eslint-env mocha */
-const { wait, startDriver, connectWS, expectEvent } = require('../utils')
+const { wait, startDriver, connectWS, expectEvent, getJSON } = require('../utils')
 const expect = require('chai').expect
 const Promise = require('bluebird')
+const rp = require('request-promise')
+const fs = require('fs')
+const os = require('os')
+const path = require('path')
 
 const mock = require('./mock')
 
@@ -151,6 +155,46 @@ describe('Basic functionality', () => {
     })
   })
 
+  it('Device information is queried on control channel', async function () {
+    this.timeout(2500)
+
+    await connectWS('ws://127.0.0.1:8382/senso').then(connectWithMockSenso)
+    const controlConnection = senso.control._connection
+
+    return expectEvent(controlConnection, 'data', (data) => {
+      // type of first block after the 8 byte header
+      return data.readUInt16LE(10) === 0xD1
+    })
+  })
+
+  it('Connection state changes are pushed to WS', async function () {
+    this.timeout(1500)
+
+    const sensoWS = await connectWS('ws://127.0.0.1:8382/senso')
+
+    const expectConnected = expectEvent(sensoWS, 'message', (s) => {
+      const msg = JSON.parse(s)
+      return msg.type === 'ConnectionStateChanged' &&
+        msg.channel === 'data' &&
+        msg.state === 'Connected' &&
+        msg.address === '127.0.0.1:55568'
+    })
+
+    sensoWS.send(JSON.stringify({
+      type: 'Connect',
+      address: '127.0.0.1'
+    }))
+
+    return expectConnected
+  })
+
+  it('Can get device information with HTTP get', async function () {
+    const device = await getJSON('http://127.0.0.1:8382/senso/device')
+    expect(device).to.have.property('address').equal(null)
+    expect(device).to.have.property('devInfo').equal(null)
+    expect(device).to.have.property('vccInfo').equal(null)
+  })
+
   it('Data is forwarded from Senso data channel to WS', async function () {
     const sensoWS = await connectWS('ws://127.0.0.1:8382/senso').then(connectWithMockSenso)
 
@@ -213,6 +257,101 @@ describe('Basic functionality', () => {
     return expectData
   })
 
+  it('Decoded measurements are sent as JSON after SetFormat', async function () {
+    this.timeout(2500)
+
+    const sensoWS = await connectWS('ws://127.0.0.1:8382/senso').then(connectWithMockSenso)
+    sensoWS.send(JSON.stringify({
+      type: 'SetFormat',
+      format: 'json'
+    }))
+    await wait(100)
+
+    const expectMeasurement = expectEvent(sensoWS, 'message', (s) => {
+      const msg = JSON.parse(s)
+      expect(msg.type).to.be.equal('Measurement')
+      expect(msg.timestamp).to.be.equal(1000)
+      expect(msg.plates).to.have.lengthOf(5)
+      expect(msg.plates[0]).to.deep.equal([1, 2, 3, 4])
+      return true
+    })
+
+    // Header and measurement block with a timestamp and 20 sensor readings
+    const packet = Buffer.alloc(8 + 4 + 44)
+    packet.writeUInt8(1, 0)
+    packet.writeUInt8(1, 1)
+    packet.writeUInt16LE(44, 8)
+    packet.writeUInt16LE(0x80, 10)
+    packet.writeUInt32LE(1000, 12)
+    for (var i = 0; i < 4; i++) {
+      packet.writeInt16LE(i + 1, 16 + 2 * i)
+    }
+
+    // Send packet in two chunks, to be reassembled by the driver
+    senso.data.stream.write(packet.slice(0, 20))
+    await wait(10)
+    senso.data.stream.write(packet.slice(20))
+
+    return expectMeasurement
+  })
+
+  it('Commands are acknowledged with the response of Senso', async function () {
+    this.timeout(2500)
+
+    const sensoWS = await connectWS('ws://127.0.0.1:8382/senso').then(connectWithMockSenso)
+    const controlConnection = senso.control._connection
+
+    // Respond to the command with a block of the request type and the response flag set
+    controlConnection.on('data', (data) => {
+      if (data.includes(Buffer.from([0x34, 0x12]))) {
+        const response = Buffer.alloc(8 + 4 + 12)
+        response.writeUInt8(1, 0)
+        response.writeUInt8(1, 1)
+        response.writeUInt16LE(12, 8)
+        response.writeUInt16LE(0x9234, 10)
+        senso.control.stream.write(response)
+      }
+    })
+
+    const expectResult = expectEvent(sensoWS, 'message', (s) => {
+      const msg = JSON.parse(s)
+      if (msg.type !== 'CommandResult') return false
+      expect(msg.id).to.be.equal('led-1')
+      expect(msg.status).to.be.equal('Acknowledged')
+      expect(msg.response.blockType).to.be.equal(0x9234)
+      return true
+    })
+
+    sensoWS.send(JSON.stringify({
+      type: 'SendCommand',
+      id: 'led-1',
+      blockType: 0x1234,
+      data: Buffer.from([1, 2, 3]).toString('base64')
+    }))
+
+    return expectResult
+  })
+
+  it('Commands are reported as not delivered without connection', async function () {
+    this.timeout(1000)
+
+    const sensoWS = await connectWS('ws://127.0.0.1:8382/senso')
+    sensoWS.send(JSON.stringify({
+      type: 'SendCommand',
+      id: 'motor-1',
+      blockType: 0x1234,
+      timeout: 200
+    }))
+
+    return expectEvent(sensoWS, 'message', (s) => {
+      const msg = JSON.parse(s)
+      if (msg.type !== 'CommandResult') return false
+      expect(msg.id).to.be.equal('motor-1')
+      expect(msg.status).to.be.equal('NotDelivered')
+      return true
+    })
+  })
+
   it('Can discover mock Senso', async function () {
     this.timeout(6000)
 
@@ -238,10 +377,183 @@ describe('Basic functionality', () => {
 
     return expectDiscovered
   })
+
+  it('Discovered Sensos are registered', async function () {
+    this.timeout(12000)
+
+    const sensoWS = await connectWS('ws://127.0.0.1:8382/senso')
+
+    // Expect a DeviceAppeared message
+    const expectAppeared = expectEvent(sensoWS, 'message', (s) => {
+      const msg = JSON.parse(s)
+      return (msg.type === 'DeviceAppeared' && msg.serial === '31-00000042')
+    })
+
+    // start fake mdns responder
+    const bonjour = require('bonjour')()
+    bonjour.publish({name: 'Registered Senso', type: 'sensoControl', port: '55567', txt: {ser_no: '31-00000042'}})
+
+    try {
+      await expectAppeared
+
+      const devices = await getJSON('http://127.0.0.1:8382/senso/devices')
+      const device = devices.find((d) => d.serial === '31-00000042')
+      expect(device).to.have.property('port').equal(55567)
+      expect(device.addresses).to.be.an('array')
+      expect(device).to.have.property('firstSeen')
+      expect(device).to.have.property('expiresAt')
+    } finally {
+      bonjour.unpublishAll()
+      bonjour.destroy()
+    }
+  })
+
+  it('Named connections are separate from the default connection', async function () {
+    this.timeout(2000)
+
+    // Opening a named connection resolves the serial
+    const namedWS = await connectWS('ws://127.0.0.1:8382/senso/31-00000043')
+    await expectEvent(namedWS, 'message', (s) => {
+      const msg = JSON.parse(s)
+      return (msg.type === 'ConnectionStateChanged' && msg.state === 'Resolving')
+    })
+
+    // The default connection is not affected
+    const sensoWS = await connectWS('ws://127.0.0.1:8382/senso')
+    sensoWS.send(JSON.stringify({ type: 'GetStatus' }))
+    await expectEvent(sensoWS, 'message', (s) => {
+      const msg = JSON.parse(s)
+      expect(msg.type).to.be.equal('Status')
+      expect(msg.address).to.be.equal(null)
+      expect(msg.channels.data.state).to.be.equal('Idle')
+      return true
+    })
+  })
+
+  it('Named connections are only created for serials', async function () {
+    this.timeout(1000)
+
+    const error = await connectWS('ws://127.0.0.1:8382/senso/not-a-serial').then(() => null, (e) => e)
+    expect(error).to.be.an('error')
+    expect(error.message).to.contain('404')
+  })
+
+  it('Named connections are closed with their last client', async function () {
+    this.timeout(2000)
+
+    const deviceURI = 'http://127.0.0.1:8382/senso/31-00000045/device'
+    const firstWS = await connectWS('ws://127.0.0.1:8382/senso/31-00000045')
+    const secondWS = await connectWS('ws://127.0.0.1:8382/senso/31-00000045')
+
+    firstWS.close()
+    await wait(200)
+    const device = await getJSON(deviceURI)
+    expect(device.address).to.be.equal(null)
+
+    secondWS.close()
+    await wait(200)
+    const response = await rp({ uri: deviceURI, resolveWithFullResponse: true, simple: false })
+    expect(response.statusCode).to.be.equal(404)
+  })
+})
+
+describe('Auto-connect', () => {
+  var driver
+  var simulator
+  var statePath
+
+  beforeEach(() => {
+    statePath = path.join(fs.mkdtempSync(path.join(os.tmpdir(), 'dividat-driver-state-')), 'senso.json')
+  })
+
+  afterEach(() => {
+    driver.kill()
+    simulator.kill()
+  })
+
+  // Start a simulated Senso and a driver auto-connecting to Sensos
+  async function start (simulatorArgs) {
+    simulator = startDriver(['simulate-senso', '-address', '127.0.0.1'].concat(simulatorArgs, ['rec/senso/zero.dat']))
+    driver = startDriver(['-senso-auto-connect', '-senso-state-file', statePath])
+    await wait(500)
+  }
+
+  it('Connects to the remembered Senso on startup', async function () {
+    this.timeout(3000)
+
+    fs.writeFileSync(statePath, JSON.stringify({ address: '127.0.0.1', serial: '31-00000005' }))
+    await start(['-serial', '31-00000005'])
+
+    const device = await expectDevice('31-00000005')
+    expect(device.address).to.be.equal('127.0.0.1')
+  })
+
+  it('Connects to the only discovered Senso and remembers it', async function () {
+    this.timeout(15000)
+
+    await start(['-advertise', '-serial', '31-00000051'])
+
+    const device = await expectDevice('31-00000051')
+    expect(device.address).to.be.equal('127.0.0.1')
+
+    await wait(100)
+    const remembered = JSON.parse(fs.readFileSync(statePath))
+    expect(remembered).to.be.deep.equal({ address: '127.0.0.1', serial: '31-00000051' })
+  })
+})
+
+describe('Connect by serial', () => {
+  var driver
+  var simulator
+
+  afterEach(() => {
+    driver.kill()
+    simulator.kill()
+  })
+
+  it('Resolves the serial of a Senso', async function () {
+    this.timeout(12000)
+
+    simulator = startDriver(['simulate-senso', '-address', '127.0.0.1', '-advertise', '-serial', '31-00000014', 'rec/senso/zero.dat'])
+    driver = startDriver()
+    await wait(500)
+
+    const sensoWS = await connectWS('ws://127.0.0.1:8382/senso')
+    sensoWS.send(JSON.stringify({ type: 'Connect', serial: '31-00000014' }))
+
+    const device = await expectDevice('31-00000014')
+    expect(device.address).to.be.equal('127.0.0.1')
+  })
+
+  it('Follows a pinned Senso to its new address', async function () {
+    this.timeout(12000)
+
+    // The Senso was remembered at an address where it can no longer be reached
+    const statePath = path.join(fs.mkdtempSync(path.join(os.tmpdir(), 'dividat-driver-state-')), 'senso.json')
+    fs.writeFileSync(statePath, JSON.stringify({ address: '127.0.0.2', serial: '31-00000015' }))
+
+    simulator = startDriver(['simulate-senso', '-address', '127.0.0.1', '-advertise', '-serial', '31-00000015', 'rec/senso/zero.dat'])
+    driver = startDriver(['-senso-auto-connect', '-senso-state-file', statePath])
+    await wait(500)
+
+    const device = await expectDevice('31-00000015')
+    expect(device.address).to.be.equal('127.0.0.1')
+  })
 })
 
 // HELPERS
 
+// Polls device information of the default connection until it is the Senso with serial
+async function expectDevice (serial) {
+  while (true) {
+    const device = await getJSON('http://127.0.0.1:8382/senso/device').catch(() => null)
+    if (device && device.devInfo && device.devInfo.controller.serialNumber === serial) {
+      return device
+    }
+    await wait(200)
+  }
+}
+
 // Returns a promise that is resolved with a new connection to a server
 function getConnection (server) {
   return new Promise((resolve, reject) => {
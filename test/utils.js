@@ -10,10 +10,21 @@ module.exports = {
     })
   },
 
-  startDriver: function () {
-    return spawn('bin/dividat-driver')
+  startDriver: function (args) {
+    return spawn('bin/dividat-driver', args || [])
     // useful for debugging:
-    // return spawn('bin/dividat-driver', [], {stdio: 'inherit'})
+    // return spawn('bin/dividat-driver', args || [], {stdio: 'inherit'})
+  },
+
+  // Run a subcommand to completion, resolving with its exit code and output
+  runDriver: function (args) {
+    return new Promise((resolve, reject) => {
+      var output = ''
+      const command = spawn('bin/dividat-driver', args)
+      command.stdout.on('data', (data) => { output += data })
+      command.on('error', reject)
+      command.on('exit', (code) => resolve({ code: code, output: output }))
+    })
   },
 
   connectWS: function (url) {
@@ -0,0 +1,62 @@
+// Read recordings in version 1 and 2 of the recording format (see src/dividat-driver/recording/main.go)
+
+const fs = require('fs')
+const zlib = require('zlib')
+const split = require('binary-split')
+
+// Returns a stream of the lines of the recording at path, which may be compressed with gzip
+function readLines (path) {
+  var stream = fs.createReadStream(path)
+  if (isGzip(path)) {
+    stream = stream.pipe(zlib.createGunzip())
+  }
+  return stream.pipe(split())
+}
+
+function isGzip (path) {
+  const fd = fs.openSync(path, 'r')
+  const magic = Buffer.alloc(2)
+  fs.readSync(fd, magic, 0, 2, 0)
+  fs.closeSync(fd)
+  return magic[0] === 0x1f && magic[1] === 0x8b
+}
+
+// Returns a parser for the lines of a recording.
+//
+// The parser returns null for lines without a packet, otherwise the milliseconds
+// to wait before the packet and its data. The data is null for packets sent to
+// the device, which are not replayed.
+function createParser () {
+  var version = 1
+  var previous = 0
+
+  return function (line) {
+    line = line.toString().trim()
+    if (line === '') {
+      return null
+    } else if (line.startsWith('{')) {
+      version = JSON.parse(line).version
+      if (version !== 2) {
+        throw new Error('Unsupported recording version ' + version)
+      }
+      return null
+    }
+
+    const items = line.split(',').map((item) => item.trim())
+    if (version === 2) {
+      const time = parseInt(items[0])
+      const delay = time - previous
+      previous = time
+      return {
+        delay: delay,
+        data: items[1] === 'rx' ? Buffer.from(items[2], 'base64') : null
+      }
+    } else if (items.length === 2) {
+      return { delay: parseInt(items[0]), data: Buffer.from(items[1], 'base64') }
+    } else {
+      return { delay: 20, data: Buffer.from(items[0], 'base64') }
+    }
+  }
+}
+
+module.exports = { readLines, createParser }
@@ -1,11 +1,11 @@
 // Mock the driver at localhost:8382 to replay Senso Flex package recordings
 
 const argv = require('minimist')(process.argv.slice(2))
-const fs = require('fs')
-const split = require('binary-split')
 const websocket = require('ws')
 const EventEmitter = require('events')
 
+const recording = require('../recording')
+
 var recFile = argv['_'].pop() || 'rec/flex/zero.dat'
 let speedFactor = 1/(parseFloat(argv['speed']) || 1)
 let loop = !argv['once']
@@ -15,27 +15,22 @@ function Replayer (recFile) {
   var emitter = new EventEmitter()
 
   function createStream () {
-    var stream = new fs.createReadStream(recFile).pipe(split())
-
-    stream.on('data', (data) => {
-      stream.pause()
+    var stream = recording.readLines(recFile)
+    var parse = recording.createParser()
 
-      var items = data.toString().split(',')
-      var msg
-      var timeout
-      if (items.length === 2) {
-        msg = items[1]
-        timeout = items[0]
-      } else {
-        msg = items[0]
-        timeout = 20
+    stream.on('data', (line) => {
+      var packet = parse(line)
+      if (packet === null) {
+        return
       }
-      var buf = Buffer.from(msg, 'base64')
-      emitter.emit('data', buf)
 
+      stream.pause()
       setTimeout(() => {
+        if (packet.data !== null) {
+          emitter.emit('data', packet.data)
+        }
         stream.resume()
-      }, timeout * speedFactor)
+      }, packet.delay * speedFactor)
     }).on('end', () => {
       if (loop) {
         console.log('End of the record stream, looping.')